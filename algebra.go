@@ -0,0 +1,230 @@
+package immutable
+
+/*
+ Structural set algebra over two tries.
+
+ Each operation recurses over both tries at once.  The nodes being combined sit at the same
+ position in the key space, but their keys may have been split at different points, so each
+ call is given the key each node should be taken to have (ka and kb), which is always a
+ suffix of the node's own key.  Where both sides hold the very same sub-trie, the result is
+ known without looking inside it.
+*/
+
+// The critical bytes and sub-tries of t, in order.
+func subsOf(t itrie) ([]byte, []itrie) {
+	n := t.occupied()
+	cbs := make([]byte, 0, n)
+	subs := make([]itrie, 0, n)
+	t.withsubs(0, 256, func(cb byte, sub itrie) { cbs = append(cbs, cb); subs = append(subs, sub) })
+	return cbs, subs
+}
+// t, with its key replaced by key.
+func rekey(t itrie, key string) itrie {
+	if t == nil || key == t.key() { return t }
+	return t.cloneWithKey(key)
+}
+// t, with key as its key and r in place of its sub-trie at cb.  r may be nil.
+func replaceSub(t itrie, key string, cb byte, r itrie) itrie {
+	cbs, subs := subsOf(t)
+	i := 0
+	for i < len(cbs) && cbs[i] < cb { i++ }
+	switch {
+	case i < len(cbs) && cbs[i] == cb && r == nil:
+		cbs = append(cbs[:i], cbs[i+1:]...)
+		subs = append(subs[:i], subs[i+1:]...)
+	case i < len(cbs) && cbs[i] == cb:
+		subs[i] = r
+	case r != nil:
+		cbs = append(cbs, 0); copy(cbs[i+1:], cbs[i:]); cbs[i] = cb
+		subs = append(subs, nil); copy(subs[i+1:], subs[i:]); subs[i] = r
+	}
+	return makeNode(key, t.val(), t.hasVal(), cbs, subs)
+}
+
+func merge(a itrie, ka string, b itrie, kb string, path string, resolve func(string, Value, Value) Value) itrie {
+	if a == nil { return rekey(b, kb) }
+	if b == nil || (a == b && ka == kb) { return rekey(a, ka) }
+
+	crit, match := findcb(ka, kb)
+	switch {
+	case match:
+		val, full := a.val(), a.hasVal()
+		if b.hasVal() {
+			if full { val = resolve(path + ka, val, b.val()) } else { val = b.val() }
+			full = true
+		}
+		acbs, asubs := subsOf(a)
+		bcbs, bsubs := subsOf(b)
+		cbs := make([]byte, 0, len(acbs) + len(bcbs))
+		subs := make([]itrie, 0, len(acbs) + len(bcbs))
+		i, j := 0, 0
+		for i < len(acbs) || j < len(bcbs) {
+			var cb byte
+			var r itrie
+			switch {
+			case j == len(bcbs) || (i < len(acbs) && acbs[i] < bcbs[j]):
+				cb, r = acbs[i], asubs[i]; i++
+			case i == len(acbs) || bcbs[j] < acbs[i]:
+				cb, r = bcbs[j], bsubs[j]; j++
+			default:
+				cb = acbs[i]
+				r = merge(asubs[i], asubs[i].key(), bsubs[j], bsubs[j].key(), path + ka + cbstr[cb], resolve)
+				i++; j++
+			}
+			cbs = append(cbs, cb); subs = append(subs, r)
+		}
+		return makeNode(ka, val, full, cbs, subs)
+	case crit == len(ka):
+		// b lies beneath one of a's sub-tries
+		cb := kb[crit]
+		sub := a.subAt(cb)
+		var r itrie
+		if sub == nil {
+			r = rekey(b, kb[crit+1:])
+		} else {
+			r = merge(sub, sub.key(), b, kb[crit+1:], path + ka + cbstr[cb], resolve)
+		}
+		return replaceSub(a, ka, cb, r)
+	case crit == len(kb):
+		// a lies beneath one of b's sub-tries
+		cb := ka[crit]
+		sub := b.subAt(cb)
+		var r itrie
+		if sub == nil {
+			r = rekey(a, ka[crit+1:])
+		} else {
+			r = merge(a, ka[crit+1:], sub, sub.key(), path + kb + cbstr[cb], resolve)
+		}
+		return replaceSub(b, kb, cb, r)
+	}
+	// The keys diverge at crit, so the two tries become siblings.
+	a, b = rekey(a, ka[crit+1:]), rekey(b, kb[crit+1:])
+	if ka[crit] > kb[crit] {
+		return makeNode(ka[:crit], nil, false, []byte{kb[crit], ka[crit]}, []itrie{b, a})
+	}
+	return makeNode(ka[:crit], nil, false, []byte{ka[crit], kb[crit]}, []itrie{a, b})
+}
+
+func intersect(a itrie, ka string, b itrie, kb string) itrie {
+	if a == nil || b == nil { return nil }
+	if a == b && ka == kb { return rekey(a, ka) }
+
+	crit, match := findcb(ka, kb)
+	switch {
+	case match:
+		var cbs []byte
+		var subs []itrie
+		a.withsubs(0, 256, func(cb byte, sub itrie) {
+			if other := b.subAt(cb); other != nil {
+				if r := intersect(sub, sub.key(), other, other.key()); r != nil {
+					cbs = append(cbs, cb); subs = append(subs, r)
+				}
+			}
+		})
+		return makeNode(ka, a.val(), a.hasVal() && b.hasVal(), cbs, subs)
+	case crit == len(ka):
+		sub := a.subAt(kb[crit])
+		if sub == nil { return nil }
+		r := intersect(sub, sub.key(), b, kb[crit+1:])
+		if r == nil { return nil }
+		return rekey(r, kb[:crit+1] + r.key())
+	case crit == len(kb):
+		sub := b.subAt(ka[crit])
+		if sub == nil { return nil }
+		r := intersect(a, ka[crit+1:], sub, sub.key())
+		if r == nil { return nil }
+		return rekey(r, ka[:crit+1] + r.key())
+	}
+	return nil
+}
+
+func difference(a itrie, ka string, b itrie, kb string) itrie {
+	if a == nil { return nil }
+	if b == nil { return rekey(a, ka) }
+	if a == b && ka == kb { return nil }
+
+	crit, match := findcb(ka, kb)
+	switch {
+	case match:
+		full := a.hasVal() && !b.hasVal()
+		changed := full != a.hasVal()
+		var cbs []byte
+		var subs []itrie
+		a.withsubs(0, 256, func(cb byte, sub itrie) {
+			r := sub
+			if other := b.subAt(cb); other != nil {
+				r = difference(sub, sub.key(), other, other.key())
+			}
+			if r != sub { changed = true }
+			if r != nil { cbs = append(cbs, cb); subs = append(subs, r) }
+		})
+		if !changed { return rekey(a, ka) }
+		return makeNode(ka, a.val(), full, cbs, subs)
+	case crit == len(ka):
+		cb := kb[crit]
+		sub := a.subAt(cb)
+		if sub == nil { return rekey(a, ka) }
+		r := difference(sub, sub.key(), b, kb[crit+1:])
+		if r == sub { return rekey(a, ka) }
+		return replaceSub(a, ka, cb, r)
+	case crit == len(kb):
+		sub := b.subAt(ka[crit])
+		if sub == nil { return rekey(a, ka) }
+		r := difference(a, ka[crit+1:], sub, sub.key())
+		if r == nil { return nil }
+		return rekey(r, ka[:crit+1] + r.key())
+	}
+	return rekey(a, ka)
+}
+
+// Whether every key in a is also in b.
+func subset(a itrie, ka string, b itrie, kb string) bool {
+	if a == nil || (a == b && ka == kb) { return true }
+	if b == nil || a.count() > b.count() { return false }
+
+	crit, match := findcb(ka, kb)
+	switch {
+	case match:
+		if a.hasVal() && !b.hasVal() { return false }
+		ok := true
+		a.withsubs(0, 256, func(cb byte, sub itrie) {
+			if !ok { return }
+			other := b.subAt(cb)
+			ok = other != nil && subset(sub, sub.key(), other, other.key())
+		})
+		return ok
+	case crit == len(ka):
+		// b lies beneath one of a's sub-tries, so that must be all a has
+		if a.hasVal() || a.occupied() > 1 { return false }
+		sub := a.subAt(kb[crit])
+		return sub != nil && subset(sub, sub.key(), b, kb[crit+1:])
+	case crit == len(kb):
+		sub := b.subAt(ka[crit])
+		return sub != nil && subset(a, ka[crit+1:], sub, sub.key())
+	}
+	return false
+}
+
+/*
+ Returns the Dict holding every entry of d and of other.  Where both hold a key, its value
+ is resolve(key, d's value, other's value), or other's value if resolve is nil.  Sub-tries
+ that d and other share are reused whole, without calling resolve for the keys inside them.
+*/
+func (d Dict) Merge(other Dict, resolve func(key string, a, b Value) Value) Dict {
+	if resolve == nil {
+		resolve = func(key string, a, b Value) Value { return b }
+	}
+	if d.t == nil { return other }
+	if other.t == nil { return d }
+	return Dict{merge(d.t, d.t.key(), other.t, other.t.key(), "", resolve)}
+}
+// Returns the Dict holding the entries of d whose keys are also in other.
+func (d Dict) Intersect(other Dict) Dict {
+	if d.t == nil || other.t == nil { return Dict{} }
+	return Dict{intersect(d.t, d.t.key(), other.t, other.t.key())}
+}
+// Returns the Dict holding the entries of d whose keys are not in other.
+func (d Dict) Difference(other Dict) Dict {
+	if d.t == nil || other.t == nil { return d }
+	return Dict{difference(d.t, d.t.key(), other.t, other.t.key())}
+}
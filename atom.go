@@ -0,0 +1,125 @@
+package immutable
+
+import (
+	"os"
+	"sync"
+)
+
+/*
+ Atom
+
+ An Atom holds the current version of a Dict for goroutines to share, after Clojure's atom.
+ Deref only waits for another goroutine to finish installing a version, never for one to
+ compute it.  A change is made by swapping in a new version only if the version it was made
+ from is still the current one, and Swap retries on its own when another goroutine got there
+ first, so fn may be called more than once and should do nothing but compute the new version.
+
+ Validators can reject a new version before it is swapped in, and watches are called with the
+ old and new versions after each change.  A watch is called by the goroutine that made the
+ change, so the watches of changes made at once by different goroutines may run at the same
+ time, and out of order.
+
+ The zero Atom holds the empty Dict.
+*/
+type Atom struct {
+	mu sync.RWMutex		// held to read or change d and h
+	d Dict
+	h *atomHooks
+}
+
+// The validators and watches of an Atom.  Each change to them makes a new atomHooks.
+type atomHooks struct {
+	validators []func(Dict) bool
+	watches Dict	// the watch functions, by their keys
+}
+
+var ErrInvalid = os.NewError("immutable: new version rejected by a validator")
+
+func NewAtom(d Dict) *Atom {
+	return &Atom{d: d}
+}
+// The current version, and the hooks to check and announce a change to it with.
+func (a *Atom) current() (Dict, *atomHooks) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.h == nil { return a.d, &atomHooks{} }
+	return a.d, a.h
+}
+// Makes d the current version if old, by identity, still is.
+func (a *Atom) compareAndSet(old, d Dict) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.d.t != old.t { return false }
+	a.d = d
+	return true
+}
+func (a *Atom) changeHooks(fn func(h *atomHooks)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var h atomHooks
+	if a.h != nil { h = *a.h }
+	fn(&h)
+	a.h = &h
+}
+func (h *atomHooks) valid(d Dict) bool {
+	for _, fn := range h.validators {
+		if !fn(d) { return false }
+	}
+	return true
+}
+func (h *atomHooks) notify(old, d Dict) {
+	h.watches.Foreach(func(key string, fn Value) { fn.(func(Dict, Dict))(old, d) })
+}
+
+// The current version.
+func (a *Atom) Deref() Dict {
+	d, _ := a.current()
+	return d
+}
+// Makes d the current version, whatever it was, unless a validator rejects d.
+func (a *Atom) Reset(d Dict) os.Error {
+	_, err := a.Swap(func(Dict) Dict { return d })
+	return err
+}
+/*
+ Makes d the current version if old, by identity, still is.  Returns whether it did, and
+ ErrInvalid if a validator rejected d.
+*/
+func (a *Atom) CompareAndSet(old, d Dict) (bool, os.Error) {
+	_, h := a.current()
+	if !h.valid(d) { return false, ErrInvalid }
+	if !a.compareAndSet(old, d) { return false, nil }
+	h.notify(old, d)
+	return true, nil
+}
+/*
+ Makes fn(current version) the current version, calling fn again on the latest version for as
+ long as another goroutine changes it first.  Returns the new version, or the current one and
+ ErrInvalid if a validator rejected what fn returned.
+*/
+func (a *Atom) Swap(fn func(Dict) Dict) (Dict, os.Error) {
+	for {
+		old, h := a.current()
+		d := fn(old)
+		if !h.valid(d) { return old, ErrInvalid }
+		if a.compareAndSet(old, d) {
+			h.notify(old, d)
+			return d, nil
+		}
+	}
+	return Dict{}, nil
+}
+
+// Adds a validator, which every later version must pass.
+func (a *Atom) AddValidator(fn func(Dict) bool) {
+	a.changeHooks(func(h *atomHooks) {
+		h.validators = append(append([]func(Dict) bool(nil), h.validators...), fn)
+	})
+}
+// Adds fn as the watch under key, replacing any watch already under key.
+func (a *Atom) AddWatch(key string, fn func(old, new Dict)) {
+	a.changeHooks(func(h *atomHooks) { h.watches = h.watches.Assoc(key, fn) })
+}
+func (a *Atom) RemoveWatch(key string) {
+	a.changeHooks(func(h *atomHooks) { h.watches = h.watches.Without(key) })
+}
@@ -16,6 +16,8 @@ type bag_ struct {
 	occupied_ uint8
 	cb [maxBagSize]byte
 	count_ int
+	sum_ int
+	editor_ *editor
 	sub [maxBagSize]itrie
 }
 type bagK struct {
@@ -30,17 +32,29 @@ type bagKV struct {
 	entryKV
 	bag_
 }
+type bagM struct {
+	entryM
+	bag_
+}
+type bagKM struct {
+	entryKM
+	bag_
+}
 
 var sizeofBag_ uintptr
 var sizeofBagK uintptr
 var sizeofBagV uintptr
 var sizeofBagKV uintptr
+var sizeofBagM uintptr
+var sizeofBagKM uintptr
 
 func init() {
 	var b_ bag_
 	var bk bagK
 	var bv bagV
 	var bkv bagKV
+	var bm bagM
+	var bkm bagKM
 	var t itrie
 
 	sizeofSub = uintptr(unsafe.Sizeof(t))
@@ -48,6 +62,8 @@ func init() {
 	sizeofBagK = uintptr(unsafe.Sizeof(bk)) - maxBagSize*sizeofSub
 	sizeofBagV = uintptr(unsafe.Sizeof(bv)) - maxBagSize*sizeofSub
 	sizeofBagKV = uintptr(unsafe.Sizeof(bkv)) - maxBagSize*sizeofSub
+	sizeofBagM = uintptr(unsafe.Sizeof(bm)) - maxBagSize*sizeofSub
+	sizeofBagKM = uintptr(unsafe.Sizeof(bkm)) - maxBagSize*sizeofSub
 }
 
 func (b *bag_) printCBs(prefix string) {
@@ -82,36 +98,64 @@ func newBagKV(size uint8) *bagKV {
 	b.occupied_ = size
 	return b
 }
+func newBagM(size uint8) *bagM {
+	asize := sizeofSub*uintptr(size)+sizeofBagM
+	b := (*bagM)(unsafe.Pointer(runtime.Alloc(asize)))
+	b.occupied_ = size
+	return b
+}
+func newBagKM(size uint8) *bagKM {
+	asize := sizeofSub*uintptr(size)+sizeofBagKM
+	b := (*bagKM)(unsafe.Pointer(runtime.Alloc(asize)))
+	b.occupied_ = size
+	return b
+}
 	
 func makeBag(size uint8, key string, val Value, full bool) (*bag_, itrie) {
+	return makeBagOwning(size, str(key), val, full)
+}
+// Like makeBag, but the bag keeps key itself rather than a copy.
+func makeBagOwning(size uint8, key string, val Value, full bool) (*bag_, itrie) {
 	emptystr := len(key) == 0
 
+	if full && isMember(val) {
+		if !emptystr {
+			tally(kBagKM)
+			b := newBagKM(size)
+			b.key_ = key; b.count_ = 1
+			return &b.bag_, b
+		}
+		tally(kBagM)
+		b := newBagM(size)
+		b.count_ = 1
+		return &b.bag_, b
+	}
 	if !emptystr {
 		if full {
-			Cumulative[kBagKV]++
+			tally(kBagKV)
 			b := newBagKV(size)
-			b.key_ = str(key); b.val_ = val; b.count_ = 1
+			b.key_ = key; b.val_ = val; b.count_ = 1; b.sum_ = weight(val)
 			return &b.bag_, b
 		}
-		Cumulative[kBagK]++
+		tally(kBagK)
 		b := newBagK(size)
-		b.key_ = str(key)
+		b.key_ = key
 		return &b.bag_, b
 	}
 	if full {
-		Cumulative[kBagV]++
+		tally(kBagV)
 		b := newBagV(size)
-		b.val_ = val; b.count_ = 1
+		b.val_ = val; b.count_ = 1; b.sum_ = weight(val)
 		return &b.bag_, b
 	}
-	Cumulative[kBag_]++
+	tally(kBag_)
 	b := newBag_(size)
 	return b, b
 }
 func (b *bag_) init1(cb byte, sub itrie) {
 	b.cb[0] = cb
 	b.sub[0] = sub
-	b.count_ += sub.count()
+	b.count_ += sub.count(); b.sum_ += sub.sum()
 }	
 func bag1(key string, val Value, full bool, cb byte, sub itrie) itrie {
 	b, t := makeBag(uint8(1), key, val, full)
@@ -123,6 +167,7 @@ func (b *bag_) init2(cb0, cb1 byte, sub0, sub1 itrie) {
 	b.cb[0] = cb0; b.cb[1] = cb1 
 	b.sub[0] = sub0; b.sub[1] = sub1
 	b.count_ += sub0.count() + sub1.count()
+	b.sum_ += sub0.sum() + sub1.sum()
 }
 func bag2(key string, val Value, full bool, cb0, cb1 byte, sub0, sub1 itrie) itrie {
 	b, t := makeBag(uint8(2), key, val, full)
@@ -135,7 +180,7 @@ func (b *bag_) fillWith(t itrie, cb byte, l itrie) {
 	t.withsubs(0, uint(cb), add)
 	add(cb, l)
 	t.withsubs(uint(cb)+1, 256, add)
-	b.count_ = t.count() + 1
+	b.count_ = t.count() + 1; b.sum_ = t.sum() + l.sum()
 }
 /*
  Constructs a new bag with the contents of t and l, where l is always a leaf.  It is known
@@ -154,96 +199,113 @@ func (b *bag_) fillWithout(t itrie, e expanse_t, without byte) {
 	index := 0
 	add := func(cb byte, t itrie) { b.sub[index] = t; b.cb[index] = cb; index++ }
 	t.withsubs(uint(e.low), uint(without), add)
-	t.withsubs(uint(without+1), uint(e.high)+1, add)
-	b.count_ = t.count() - 1
+	t.withsubs(uint(without)+1, uint(e.high)+1, add)
+	b.count_ = t.count() - 1; b.sum_ = t.sum() - t.subAt(without).sum()
 }
 func bagWithout(t itrie, e expanse_t, without byte) itrie {
-	size := uint8(t.occupied()-1)
-	if len(t.key()) > 0 {
-		if t.hasVal() {
-			b := newBagKV(size)
-			b.key_ = t.key(); b.val_ = t.val()
-			b.fillWithout(t, e, without)
-			return b
-		}
-		b := newBagK(size)
-		b.key_ = t.key()
-		b.fillWithout(t, e, without)
-		return b
-	}
-	if t.hasVal() {
-		b := newBagV(size)
-		b.val_ = t.val()
-		b.fillWithout(t, e, without)
-		return b
-	}
-	b := newBag_(size)
+	b, r := makeBagOwning(uint8(t.occupied()-1), t.key(), t.val(), t.hasVal())
 	b.fillWithout(t, e, without)
-	return b
+	return r
 }
 func (b *bag_) copy(t *bag_) {
-	b.count_ = t.count_; b.occupied_ = t.occupied_
+	b.count_ = t.count_; b.sum_ = t.sum_; b.occupied_ = t.occupied_
 	copy(b.cb[:t.occupied_], t.cb[:t.occupied_])
 	copy(b.sub[:b.occupied_], t.sub[:t.occupied_])
 }
 func (b *bag_) modify(incr, i int, sub itrie) itrie {
 	n := newBag_(b.occupied_)
-	n.copy(b); n.count_ += incr; n.sub[i] = sub
+	n.copy(b); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (b *bagK) modify(incr, i int, sub itrie) itrie {
 	n := newBagK(b.occupied_)
 	n.key_ = b.key_;
-	n.copy(&b.bag_); n.count_ += incr; n.sub[i] = sub
+	n.copy(&b.bag_); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (b *bagV) modify(incr, i int, sub itrie) itrie {
 	n := newBagV(b.occupied_)
 	n.val_ = b.val_
-	n.copy(&b.bag_); n.count_ += incr; n.sub[i] = sub
+	n.copy(&b.bag_); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (b *bagKV) modify(incr, i int, sub itrie) itrie {
 	n := newBagKV(b.occupied_)
 	n.key_ = b.key_; n.val_ = b.val_;
-	n.copy(&b.bag_); n.count_ += incr; n.sub[i] = sub
+	n.copy(&b.bag_); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
+	return n
+}
+func (b *bagM) modify(incr, i int, sub itrie) itrie {
+	n := newBagM(b.occupied_)
+	n.copy(&b.bag_); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
+	return n
+}
+func (b *bagKM) modify(incr, i int, sub itrie) itrie {
+	n := newBagKM(b.occupied_)
+	n.key_ = b.key_
+	n.copy(&b.bag_); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (b *bag_) cloneWithKey(key string) itrie {
 	n := newBagK(b.occupied_)
-	Cumulative[kBagK]++
+	tally(kBagK)
 	n.copy(b); n.key_ = str(key)
 	return n
 }
 func (b *bagV) cloneWithKey(key string) itrie {
 	n := newBagKV(b.occupied_)
-	Cumulative[kBagKV]++
+	tally(kBagKV)
 	n.copy(&b.bag_); n.key_ = str(key); n.val_ = b.val_
 	return n
 }
 func (b *bagKV) cloneWithKey(key string) itrie {
 	n := newBagKV(b.occupied_)
-	Cumulative[kBagKV]++
+	tally(kBagKV)
 	n.copy(&b.bag_); n.key_ = str(key); n.val_ = b.val_
 	return n
 }	
-func (b *bag_) cloneWithKeyValue(key string, val Value) (itrie, int) {
+func (b *bagM) cloneWithKey(key string) itrie {
+	n := newBagKM(b.occupied_)
+	tally(kBagKM)
+	n.copy(&b.bag_); n.key_ = str(key)
+	return n
+}
+func (b *bagKM) cloneWithKey(key string) itrie {
+	n := newBagKM(b.occupied_)
+	tally(kBagKM)
+	n.copy(&b.bag_); n.key_ = str(key)
+	return n
+}
+/*
+ A copy of b, whose own value was old, holding val at key, and added more entries.  A Set's
+ member makes a bagKM, and any other value a bagKV, whatever kind b is.
+*/
+func (b *bag_) cloneValued(key string, old, val Value, added int) itrie {
+	if isMember(val) {
+		n := newBagKM(b.occupied_)
+		tally(kBagKM)
+		n.copy(b); n.key_ = key; n.count_ += added; n.sum_ -= weight(old)
+		return n
+	}
 	n := newBagKV(b.occupied_)
-	Cumulative[kBagKV]++
-	n.copy(b); n.key_ = str(key); n.val_ = val; n.count_++
-	return n, 1
+	tally(kBagKV)
+	n.copy(b); n.key_ = key; n.val_ = val; n.count_ += added; n.sum_ += weight(val) - weight(old)
+	return n
+}
+func (b *bag_) cloneWithKeyValue(key string, val Value) (itrie, int) {
+	return b.cloneValued(key, nil, val, 1), 1
 }
 func (b *bagV) cloneWithKeyValue(key string, val Value) (itrie, int) {
-	n := newBagKV(b.occupied_)
-	Cumulative[kBagKV]++
-	n.copy(&b.bag_); n.key_ = str(key); n.val_ = val
-	return n, 0
+	return b.cloneValued(key, b.val_, val, 0), 0
 }
 func (b *bagKV) cloneWithKeyValue(key string, val Value) (itrie, int) {
-	n := newBagKV(b.occupied_)
-	Cumulative[kBagKV]++
-	n.copy(&b.bag_); n.key_ = str(key); n.val_ = val
-	return n, 0
+	return b.cloneValued(key, b.val_, val, 0), 0
+}
+func (b *bagM) cloneWithKeyValue(key string, val Value) (itrie, int) {
+	return b.cloneValued(key, member, val, 0), 0
+}
+func (b *bagKM) cloneWithKeyValue(key string, val Value) (itrie, int) {
+	return b.cloneValued(key, member, val, 0), 0
 }
 func (b *bag_) withoutValue() (itrie, int) {
 	return b, 0
@@ -252,19 +314,31 @@ func (b *bagK) withoutValue() (itrie, int) {
 	return b, 0
 }
 func (b *bag_) collapse(key string) (itrie, int) {
-	key += string(b.cb[0]) + b.sub[0].key()
+	key += cbstr[b.cb[0]] + b.sub[0].key()
 	return b.sub[0].cloneWithKey(key), 1
 }
 func (b *bagV) withoutValue() (itrie, int) {
 	if b.occupied_ == 1 { return b.collapse("") }
 	n := newBag_(b.occupied_)
-	n.copy(&b.bag_)
+	n.copy(&b.bag_); n.count_--; n.sum_ -= weight(b.val_)
 	return n, 1
 }
 func (b *bagKV) withoutValue() (itrie, int) {
 	if b.occupied_ == 1 { return b.collapse(b.key_) }
 	n := newBagK(b.occupied_)
-	n.copy(&b.bag_); n.key_ = b.key_; n.bag_ = b.bag_
+	n.copy(&b.bag_); n.key_ = b.key_; n.count_--; n.sum_ -= weight(b.val_)
+	return n, 1
+}
+func (b *bagM) withoutValue() (itrie, int) {
+	if b.occupied_ == 1 { return b.collapse("") }
+	n := newBag_(b.occupied_)
+	n.copy(&b.bag_); n.count_--
+	return n, 1
+}
+func (b *bagKM) withoutValue() (itrie, int) {
+	if b.occupied_ == 1 { return b.collapse(b.key_) }
+	n := newBagK(b.occupied_)
+	n.copy(&b.bag_); n.key_ = b.key_; n.count_--
 	return n, 1
 }
 func (n *bag_) withBag(b *bag_, incr int, size uint8, i int, cb byte, r itrie) {
@@ -278,13 +352,13 @@ func (n *bag_) withBag(b *bag_, incr int, size uint8, i int, cb byte, r itrie) {
 	if size == b.occupied_ { src++ }
 	copy(n.cb[dst:n.occupied_], b.cb[src:b.occupied_])
 	copy(n.sub[dst:n.occupied_], b.sub[src:b.occupied_])
-	n.count_ = b.count_ + incr
+	n.count_ = b.count_ + incr; n.sum_ = b.sum_ + r.sum() - sumOf(b.subAt(cb))
 }
 func (b *bag_) with(incr int, cb byte, r itrie) itrie {
 	t, size, i := b.maybeGrow(b, cb, r)
 	if t != nil { return t }
 	n := newBag_(size)
-	Cumulative[kBag_]++
+	tally(kBag_)
 	n.withBag(b, incr, size, i, cb, r)
 	return n
 }
@@ -292,7 +366,7 @@ func (b *bagK) with(incr int, cb byte, r itrie) itrie {
 	t, size, i := b.maybeGrow(b, cb, r)
 	if t != nil { return t }
 	n := newBagK(size)
-	Cumulative[kBagK]++
+	tally(kBagK)
 	n.key_ = b.key_
 	n.withBag(&b.bag_, incr, size, i, cb, r)
 	return n
@@ -301,7 +375,7 @@ func (b *bagV) with(incr int, cb byte, r itrie) itrie {
 	t, size, i := b.maybeGrow(b, cb, r)
 	if t != nil { return t }
 	n := newBagV(size)
-	Cumulative[kBagV]++
+	tally(kBagV)
 	n.val_ = b.val_
 	n.withBag(&b.bag_, incr, size, i, cb, r)
 	return n
@@ -310,11 +384,28 @@ func (b *bagKV) with(incr int, cb byte, r itrie) itrie {
 	t, size, i := b.maybeGrow(b, cb, r)
 	if t != nil { return t }
 	n := newBagKV(size)
-	Cumulative[kBagKV]++
+	tally(kBagKV)
 	n.key_ = b.key_; n.val_ = b.val_
 	n.withBag(&b.bag_, incr, size, i, cb, r)
 	return n
 }
+func (b *bagM) with(incr int, cb byte, r itrie) itrie {
+	t, size, i := b.maybeGrow(b, cb, r)
+	if t != nil { return t }
+	n := newBagM(size)
+	tally(kBagM)
+	n.withBag(&b.bag_, incr, size, i, cb, r)
+	return n
+}
+func (b *bagKM) with(incr int, cb byte, r itrie) itrie {
+	t, size, i := b.maybeGrow(b, cb, r)
+	if t != nil { return t }
+	n := newBagKM(size)
+	tally(kBagKM)
+	n.key_ = b.key_
+	n.withBag(&b.bag_, incr, size, i, cb, r)
+	return n
+}
 func (b *bag_) find(cb byte) (int, bool) {
 	// Even though it's sorted, since len <= 7, it's almost certainly not worth it to
 	// binary search.  We can still take advantage of early out.
@@ -329,6 +420,16 @@ func (b *bag_) subAt(cb byte) itrie {
 	if found { return b.sub[i] }
 	return nil
 }
+func (b *bag_) setSub(incr, dsum int, cb byte, r itrie) {
+	i, _ := b.find(cb)
+	b.sub[i] = r; b.count_ += incr; b.sum_ += dsum
+}
+func (b *bagV) setVal(val Value) {
+	b.sum_ += weight(val) - weight(b.val_); b.val_ = val
+}
+func (b *bagKV) setVal(val Value) {
+	b.sum_ += weight(val) - weight(b.val_); b.val_ = val
+}
 func (b *bag_) maybeGrow(t itrie, cb byte, r itrie) (itrie, uint8, int) {
 	i, found := b.find(cb)
 	size := b.occupied_
@@ -367,6 +468,12 @@ func (b *bagV) without(cb byte, r itrie) itrie {
 func (b *bagKV) without(cb byte, r itrie) itrie {
 	return b.without_(b, cb, r)
 }
+func (b *bagM) without(cb byte, r itrie) itrie {
+	return b.without_(b, cb, r)
+}
+func (b *bagKM) without(cb byte, r itrie) itrie {
+	return b.without_(b, cb, r)
+}
 func (b *bag_) shrink(t itrie, cb byte) itrie {
 	i, _ := b.find(cb)
 
@@ -379,7 +486,7 @@ func (b *bag_) shrink(t itrie, cb byte) itrie {
 		return leaf(t.key(), t.val())
 	} else if last == 1 && !t.hasVal() {
 		o := 1 - i
-		key := t.key() + string(b.cb[o]) + b.sub[o].key()
+		key := t.key() + cbstr[b.cb[o]] + b.sub[o].key()
 		return b.sub[o].cloneWithKey(key)
 	}
 	e := b.expanse()
@@ -402,13 +509,22 @@ func (b *bagV) foreach(prefix string, f func(key string, val Value)) {
 	f(prefix, b.val_)
 	b.bag_.foreach(prefix, f)
 }
+func (b *bagKM) foreach(prefix string, f func(key string, val Value)) {
+	prefix += b.key_
+	f(prefix, member)
+	b.bag_.foreach(prefix, f)
+}
+func (b *bagM) foreach(prefix string, f func(key string, val Value)) {
+	f(prefix, member)
+	b.bag_.foreach(prefix, f)
+}
 func (b *bagK) foreach(prefix string, f func(key string, val Value)) {
 	prefix += b.key_
 	b.bag_.foreach(prefix, f)
 }
 func (b *bag_) foreach(prefix string, f func(key string, val Value)) {
-	for i, sub := range b.sub {
-		sub.foreach(prefix + string(b.cb[i]), f)
+	for i, sub := range b.sub[:b.occupied_] {
+		sub.foreach(prefix + cbstr[b.cb[i]], f)
 	}
 }
 func (b *bag_) withsubs(start, end uint, f func(byte, itrie)) {
@@ -418,8 +534,23 @@ func (b *bag_) withsubs(start, end uint, f func(byte, itrie)) {
 		f(b.cb[i], b.sub[i])
 	}
 }
+func (b *bag_) nextSub(cb uint) (byte, itrie) {
+	for i := 0; i < int(b.occupied_); i++ {
+		if uint(b.cb[i]) >= cb { return b.cb[i], b.sub[i] }
+	}
+	return 0, nil
+}
+func (b *bag_) prevSub(cb uint) (byte, itrie) {
+	for i := int(b.occupied_)-1; i >= 0; i-- {
+		if uint(b.cb[i]) < cb { return b.cb[i], b.sub[i] }
+	}
+	return 0, nil
+}
 func (b *bag_) count() int { return b.count_ }
+func (b *bag_) sum() int { return b.sum_ }
 func (b *bag_) occupied() int { return int(b.occupied_) }
+func (b *bag_) editor() *editor { return b.editor_ }
+func (b *bag_) setEditor(ed *editor) { b.editor_ = ed }
 func (b *bag_) expanse() expanse_t { return expanse(b.cb[0], b.cb[int(b.occupied_)-1]) }
 func (b *bag_) expanseWithout(cb byte) expanse_t {
 	if b.occupied_ == 0 { panic("Shouldn't have an empty bag.") }
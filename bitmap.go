@@ -12,8 +12,9 @@ type bitmap_ struct {
 	entry_
 	occupied_ uint16
 	count_ int
-	off [4]uint8
-	bm [4]uint64
+	sum_ int
+	bitset
+	editor_ *editor
 	sub [256]itrie		// We don't actually allocate 256 entries
 }
 type bitmapK struct {
@@ -28,11 +29,21 @@ type bitmapKV struct {
 	entryKV
 	bitmap_
 }
+type bitmapM struct {
+	entryM
+	bitmap_
+}
+type bitmapKM struct {
+	entryKM
+	bitmap_
+}
 
 var sizeofBitmap_ uintptr
 var sizeofBitmapK uintptr
 var sizeofBitmapV uintptr
 var sizeofBitmapKV uintptr
+var sizeofBitmapM uintptr
+var sizeofBitmapKM uintptr
 var sizeofSub uintptr
 
 func init() {
@@ -40,6 +51,8 @@ func init() {
 	var bk bitmapK
 	var bv bitmapV
 	var bkv bitmapKV
+	var bm bitmapM
+	var bkm bitmapKM
 	var t itrie
 
 	sizeofSub = uintptr(unsafe.Sizeof(t))
@@ -47,6 +60,8 @@ func init() {
 	sizeofBitmapK = uintptr(unsafe.Sizeof(bk)) - 256*sizeofSub
 	sizeofBitmapV = uintptr(unsafe.Sizeof(bv)) - 256*sizeofSub
 	sizeofBitmapKV = uintptr(unsafe.Sizeof(bkv)) - 256*sizeofSub
+	sizeofBitmapM = uintptr(unsafe.Sizeof(bm)) - 256*sizeofSub
+	sizeofBitmapKM = uintptr(unsafe.Sizeof(bkm)) - 256*sizeofSub
 }
 
 /*
@@ -74,21 +89,33 @@ func reverse(bits uint64) uint64 {
 	bits = ((bits >> 32) & m32) | ((bits & m32) << 32)
 	return bits
 }
+/*
+ bitset
+
+ The set of occupied critical bytes of a node, one bit for each, with the number of bits set in
+ the words before each word, so that a critical byte's index among the node's sub-tries can be
+ found from its bit in constant time.
+*/
+type bitset struct {
+	off [4]uint8
+	bm [4]uint64
+}
+
 func bitpos(ch uint) (int, uint64) {
 	return int((ch >> 6)), uint64(1) << (ch & 0x3f)
 }
-func (b *bitmap_) setbit(w int, bit uint64) {
+func (b *bitset) setbit(w int, bit uint64) {
 	b.bm[w] |= bit
 	for ; w < 3; w++ { b.off[w+1] += 1 }
 }
-func (b *bitmap_) clearbit(w int, bit uint64) {
+func (b *bitset) clearbit(w int, bit uint64) {
 	b.bm[w] &= ^bit
 	for ; w < 3; w++ { b.off[w+1] -= 1 }
 }
-func (b *bitmap_) isset(w int, bit uint64) bool {
+func (b *bitset) isset(w int, bit uint64) bool {
 	return b.bm[w] & bit != 0
 }
-func (b *bitmap_) indexOf(w int, bit uint64) int {
+func (b *bitset) indexOf(w int, bit uint64) int {
 	return int(countbits(b.bm[w] & (bit-1)) + b.off[w])
 }
 func minbit(bm uint64) byte {
@@ -100,39 +127,41 @@ func maxbit(bm uint64) byte {
 	bit := bm ^ (bm & (bm-1))
 	return byte(63) - countbits(bit-1)
 }
-func (b *bitmap_) min() byte {
+func (b *bitset) min() byte {
 	for w, bm := range b.bm {
 		if bm == 0 { continue }
 		return minbit(bm) + byte(64*w)
 	}
 	panic("Didn't find any bits set in bitmap")
 }
-func (b *bitmap_) max() byte {
+func (b *bitset) max() byte {
 	for w := 3; w >= 0; w-- {
 		if b.bm[w] == 0 { continue }
 		return maxbit(b.bm[w]) + byte(64*w)
 	}
 	panic("Didn't find any bits set in bitmap")
 }
-func (b *bitmap_) lastBefore(cb byte) byte {
+// Returns the greatest occupied critical byte below cb, or cb itself if there is none.
+func (b *bitset) lastBefore(cb byte) byte {
 	w, bit := bitpos(uint(cb))
 	mask := bit - 1
 	bm := b.bm[w] & mask
-	if bm != 0 { return maxbit(bm) }
-	for ; w >= 0; w-- {
+	if bm != 0 { return maxbit(bm) + byte(64*w) }
+	for w--; w >= 0; w-- {
 		if b.bm[w] == 0 { continue }
-		return maxbit(b.bm[w])
+		return maxbit(b.bm[w]) + byte(64*w)
 	}		
 	return cb
 }
-func (b *bitmap_) firstAfter(cb byte) byte {
+// Returns the least occupied critical byte above cb, or cb itself if there is none.
+func (b *bitset) firstAfter(cb byte) byte {
 	w, bit := bitpos(uint(cb))
 	mask := ^((bit - 1) | bit)
 	bm := b.bm[w] & mask
-	if bm != 0 { return minbit(bm) }
-	for ; w < 4; w++ {
+	if bm != 0 { return minbit(bm) + byte(64*w) }
+	for w++; w < 4; w++ {
 		if b.bm[w] == 0 { continue }
-		return minbit(b.bm[w])
+		return minbit(b.bm[w]) + byte(64*w)
 	}
 	return cb
 }
@@ -160,28 +189,49 @@ func newBitmapKV(size uint16) *bitmapKV {
 	b.occupied_ = size
 	return b
 }
+func newBitmapM(size uint16) *bitmapM {
+	asize := sizeofSub*uintptr(size)+sizeofBitmapM
+	b := (*bitmapM)(unsafe.Pointer(runtime.Alloc(asize)))
+	b.occupied_ = size
+	return b
+}
+func newBitmapKM(size uint16) *bitmapKM {
+	asize := sizeofSub*uintptr(size)+sizeofBitmapKM
+	b := (*bitmapKM)(unsafe.Pointer(runtime.Alloc(asize)))
+	b.occupied_ = size
+	return b
+}
 func makeBitmap(size int, key string, val Value, full bool) (b *bitmap_, t itrie) {
 	occupied := uint16(size)
 	emptystr := len(key) == 0
 
 	switch {
+	case !emptystr && full && isMember(val):
+		tally(kBitmapKM)
+		n := newBitmapKM(occupied)
+		n.key_ = str(key)
+		b, t = &n.bitmap_, n
+	case emptystr && full && isMember(val):
+		tally(kBitmapM)
+		n := newBitmapM(occupied)
+		b, t = &n.bitmap_, n
 	case !emptystr && full:
-		Cumulative[kBitmapKV]++
+		tally(kBitmapKV)
 		n := newBitmapKV(occupied)
 		n.key_ = str(key); n.val_ = val
 		b, t = &n.bitmap_, n
 	case !emptystr && !full:
-		Cumulative[kBitmapK]++
+		tally(kBitmapK)
 		n := newBitmapK(occupied)
 		n.key_ = str(key)
 		b, t = &n.bitmap_, n
 	case emptystr && full:
-		Cumulative[kBitmapV]++
+		tally(kBitmapV)
 		n := newBitmapV(occupied)
 		n.val_ = val
 		b, t = &n.bitmap_, n
 	case emptystr && !full:
-		Cumulative[kBitmap_]++
+		tally(kBitmap_)
 		n := newBitmap_(occupied)
 		b, t = n, n
 	}
@@ -200,8 +250,8 @@ func bitmap(t itrie, cb byte, l itrie) itrie {
 	}
 	t.withsubs(0, uint(cb), add)
 	add(cb, l)
-	t.withsubs(uint(cb+1), 256, add)
-	bm.count_ = t.count() + 1
+	t.withsubs(uint(cb)+1, 256, add)
+	bm.count_ = t.count() + 1; bm.sum_ = t.sum() + l.sum()
 	return r
 }
 /*
@@ -215,69 +265,104 @@ func bitmapWithout(t itrie, e expanse_t, without byte) itrie {
 		bm.sub[index] = t; bm.setbit(bitpos(uint(cb))); index++
 	}
 	t.withsubs(uint(e.low), uint(without), add)
-	t.withsubs(uint(without+1), uint(e.high)+1, add)
-	bm.count_ = t.count() - 1
+	t.withsubs(uint(without)+1, uint(e.high)+1, add)
+	bm.count_ = t.count() - 1; bm.sum_ = t.sum() - t.subAt(without).sum()
 	return r
 }
 
 func (b *bitmap_) copy(t *bitmap_) {
-	b.occupied_ = t.occupied_; b.count_ = t.count_;	b.off = t.off; b.bm = t.bm
+	b.occupied_ = t.occupied_; b.count_ = t.count_; b.sum_ = t.sum_; b.off = t.off; b.bm = t.bm
 	copy(b.sub[:b.occupied_], t.sub[:t.occupied_])
 }	
 func (b *bitmap_) cloneWithKey(key string) (t itrie) {
 	n := newBitmapK(b.occupied_)
-	Cumulative[kBitmapK]++
+	tally(kBitmapK)
 	n.copy(b); n.key_ = str(key)
 	return n
 }
 func (b *bitmapV) cloneWithKey(key string) (t itrie) {
 	n := newBitmapKV(b.occupied_)
-	Cumulative[kBitmapKV]++
+	tally(kBitmapKV)
 	n.copy(&b.bitmap_); n.key_ = str(key); n.val_ = b.val_
 	return n
 }
 func (b *bitmapKV) cloneWithKey(key string) (t itrie) {
 	n := newBitmapKV(b.occupied_)
-	Cumulative[kBitmapKV]++
+	tally(kBitmapKV)
 	n.copy(&b.bitmap_); n.key_ = str(key); n.val_ = b.val_
 	return n
 }
-func (b *bitmap_) cloneWithKeyValue(key string, val Value) (t itrie, added int) {
+func (b *bitmapM) cloneWithKey(key string) (t itrie) {
+	n := newBitmapKM(b.occupied_)
+	tally(kBitmapKM)
+	n.copy(&b.bitmap_); n.key_ = str(key)
+	return n
+}
+func (b *bitmapKM) cloneWithKey(key string) (t itrie) {
+	n := newBitmapKM(b.occupied_)
+	tally(kBitmapKM)
+	n.copy(&b.bitmap_); n.key_ = str(key)
+	return n
+}
+/*
+ A copy of b, whose own value was old, holding val at key, and added more entries.  A Set's
+ member makes a bitmapKM, and any other value a bitmapKV, whatever kind b is.
+*/
+func (b *bitmap_) cloneValued(key string, old, val Value, added int) itrie {
+	if isMember(val) {
+		n := newBitmapKM(b.occupied_)
+		tally(kBitmapKM)
+		n.copy(b); n.key_ = key; n.count_ += added; n.sum_ -= weight(old)
+		return n
+	}
 	n := newBitmapKV(b.occupied_)
-	Cumulative[kBitmapKV]++
-	n.copy(b); n.key_ = str(key); n.val_ = val; n.count_++
-	return n, 1
+	tally(kBitmapKV)
+	n.copy(b); n.key_ = key; n.val_ = val; n.count_ += added; n.sum_ += weight(val) - weight(old)
+	return n
+}
+func (b *bitmap_) cloneWithKeyValue(key string, val Value) (t itrie, added int) {
+	return b.cloneValued(key, nil, val, 1), 1
 }
 func (b *bitmapV) cloneWithKeyValue(key string, val Value) (t itrie, added int) {
-	n := newBitmapKV(b.occupied_)
-	Cumulative[kBitmapKV]++
-	n.copy(&b.bitmap_); n.key_ = str(key); n.val_ = val
-	return n, 0
+	return b.cloneValued(key, b.val_, val, 0), 0
 }
 func (b *bitmapKV) cloneWithKeyValue(key string, val Value) (t itrie, added int) {
-	n := newBitmapKV(b.occupied_)
-	Cumulative[kBitmapKV]++
-	n.copy(&b.bitmap_); n.key_ = str(key); n.val_ = val
-	return n, 0
+	return b.cloneValued(key, b.val_, val, 0), 0
+}
+func (b *bitmapM) cloneWithKeyValue(key string, val Value) (t itrie, added int) {
+	return b.cloneValued(key, member, val, 0), 0
+}
+func (b *bitmapKM) cloneWithKeyValue(key string, val Value) (t itrie, added int) {
+	return b.cloneValued(key, member, val, 0), 0
 }
 func (b *bitmap_) modify(incr, i int, sub itrie) (t itrie) {
 	n := newBitmap_(b.occupied_)
-	n.copy(b); n.count_ += incr; n.sub[i] = sub
+	n.copy(b); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (b *bitmapK) modify(incr, i int, sub itrie) (t itrie) {
 	n := newBitmapK(b.occupied_)
-	n.copy(&b.bitmap_); n.key_ = b.key_; n.count_ += incr; n.sub[i] = sub
+	n.copy(&b.bitmap_); n.key_ = b.key_; n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (b *bitmapV) modify(incr, i int, sub itrie) (t itrie) {
 	n := newBitmapV(b.occupied_)
-	n.copy(&b.bitmap_); n.val_ = b.val_; n.count_ += incr; n.sub[i] = sub
+	n.copy(&b.bitmap_); n.val_ = b.val_; n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (b *bitmapKV) modify(incr, i int, sub itrie) (t itrie) {
 	n := newBitmapKV(b.occupied_)
-	n.copy(&b.bitmap_); n.key_ = b.key_; n.val_ = b.val_; n.count_ += incr; n.sub[i] = sub
+	n.copy(&b.bitmap_); n.key_ = b.key_; n.val_ = b.val_; n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
+	return n
+}
+func (b *bitmapM) modify(incr, i int, sub itrie) (t itrie) {
+	n := newBitmapM(b.occupied_)
+	n.copy(&b.bitmap_); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
+	return n
+}
+func (b *bitmapKM) modify(incr, i int, sub itrie) (t itrie) {
+	n := newBitmapKM(b.occupied_)
+	n.copy(&b.bitmap_); n.key_ = b.key_; n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (b *bitmap_) withoutValue() (itrie, int) {
@@ -290,16 +375,27 @@ func (b *bitmapK) withoutValue() (itrie, int) {
 // if we can collapse them when removing a value.
 func (b *bitmapV) withoutValue() (t itrie, removed int) {
 	n := newBitmap_(b.occupied_)
-	n.copy(&b.bitmap_)
+	n.copy(&b.bitmap_); n.count_--; n.sum_ -= weight(b.val_)
 	return n, 1
 }
 func (b *bitmapKV) withoutValue() (t itrie, removed int) {
 	n := newBitmapK(b.occupied_)
-	n.copy(&b.bitmap_); n.key_ = b.key_
+	n.copy(&b.bitmap_); n.key_ = b.key_; n.count_--; n.sum_ -= weight(b.val_)
+	return n, 1
+}
+func (b *bitmapM) withoutValue() (t itrie, removed int) {
+	n := newBitmap_(b.occupied_)
+	n.copy(&b.bitmap_); n.count_--
+	return n, 1
+}
+func (b *bitmapKM) withoutValue() (t itrie, removed int) {
+	n := newBitmapK(b.occupied_)
+	n.copy(&b.bitmap_); n.key_ = b.key_; n.count_--
 	return n, 1
 }
 func (n *bitmap_) withBitmap(b *bitmap_, incr int, cb byte, r itrie) {
 	n.off = b.off; n.bm = b.bm; n.count_ = b.count_ + incr
+	n.sum_ = b.sum_ + r.sum() - sumOf(b.subAt(cb))
 	w, bit := bitpos(uint(cb))
 	exists := b.isset(w, bit)
 	i := b.indexOf(w, bit)
@@ -312,7 +408,7 @@ func (b *bitmap_) with(incr int, cb byte, r itrie) itrie {
 	t, size := b.maybeGrow(b, cb, r)
 	if t != nil { return t }
 	n := newBitmap_(size)
-	Cumulative[kBitmap_]++
+	tally(kBitmap_)
 	n.withBitmap(b, incr, cb, r)
 	return n
 }
@@ -320,7 +416,7 @@ func (b *bitmapK) with(incr int, cb byte, r itrie) itrie {
 	t, size := b.maybeGrow(b, cb, r)
 	if t != nil { return t }
 	n := newBitmapK(size)
-	Cumulative[kBitmap_]++
+	tally(kBitmapK)
 	n.key_ = b.key_
 	n.withBitmap(&b.bitmap_, incr, cb, r)
 	return n
@@ -329,7 +425,7 @@ func (b *bitmapV) with(incr int, cb byte, r itrie) itrie {
 	t, size := b.maybeGrow(b, cb, r)
 	if t != nil { return t }
 	n := newBitmapV(size)
-	Cumulative[kBitmap_]++
+	tally(kBitmapV)
 	n.val_ = b.val_
 	n.withBitmap(&b.bitmap_, incr, cb, r)
 	return n
@@ -338,16 +434,43 @@ func (b *bitmapKV) with(incr int, cb byte, r itrie) itrie {
 	t, size := b.maybeGrow(b, cb, r)
 	if t != nil { return t }
 	n := newBitmapKV(size)
-	Cumulative[kBitmap_]++
+	tally(kBitmapKV)
 	n.key_ = b.key_; n.val_ = b.val_
 	n.withBitmap(&b.bitmap_, incr, cb, r)
 	return n
 }
+func (b *bitmapM) with(incr int, cb byte, r itrie) itrie {
+	t, size := b.maybeGrow(b, cb, r)
+	if t != nil { return t }
+	n := newBitmapM(size)
+	tally(kBitmapM)
+	n.withBitmap(&b.bitmap_, incr, cb, r)
+	return n
+}
+func (b *bitmapKM) with(incr int, cb byte, r itrie) itrie {
+	t, size := b.maybeGrow(b, cb, r)
+	if t != nil { return t }
+	n := newBitmapKM(size)
+	tally(kBitmapKM)
+	n.key_ = b.key_
+	n.withBitmap(&b.bitmap_, incr, cb, r)
+	return n
+}
 func (b *bitmap_) subAt(cb byte) itrie {
 	w, bit := bitpos(uint(cb))
 	if !b.isset(w, bit) { return nil }
 	return b.sub[b.indexOf(w, bit)]
 }
+func (b *bitmap_) setSub(incr, dsum int, cb byte, r itrie) {
+	w, bit := bitpos(uint(cb))
+	b.sub[b.indexOf(w, bit)] = r; b.count_ += incr; b.sum_ += dsum
+}
+func (b *bitmapV) setVal(val Value) {
+	b.sum_ += weight(val) - weight(b.val_); b.val_ = val
+}
+func (b *bitmapKV) setVal(val Value) {
+	b.sum_ += weight(val) - weight(b.val_); b.val_ = val
+}
 func (b *bitmap_) maybeGrow(t itrie, cb byte, r itrie) (itrie, uint16) {
 	// Figure out if we stay a bitmap or if we can become a span
 	// we know we're too big to be a bag
@@ -371,7 +494,7 @@ func (b *bitmap_) without_(t itrie, cb byte, r itrie) itrie {
 	}
 	w, bit := bitpos(uint(cb))
 	i := b.indexOf(w, bit)
-	return b.modify(-1, i, r)
+	return t.modify(-1, i, r)
 }
 func (b *bitmap_) without(cb byte, r itrie) itrie {
 	return b.without_(b, cb, r)
@@ -385,6 +508,12 @@ func (b *bitmapV) without(cb byte, r itrie) itrie {
 func (b *bitmapKV) without(cb byte, r itrie) itrie {
 	return b.without_(b, cb, r)
 }
+func (b *bitmapM) without(cb byte, r itrie) itrie {
+	return b.without_(b, cb, r)
+}
+func (b *bitmapKM) without(cb byte, r itrie) itrie {
+	return b.without_(b, cb, r)
+}
 func (b *bitmap_) shrink(t itrie, cb byte) itrie {
 	// We removed a leaf -- shrink our children & possibly turn into a bag or span.
 	occupied := int(b.occupied_) - 1
@@ -400,6 +529,15 @@ func (b *bitmap_) shrink(t itrie, cb byte) itrie {
 	// We should stay a bitmap
 	return bitmapWithout(t, e, cb)
 }
+func (b *bitmapKM) foreach(prefix string, f func(string, Value)) {
+	prefix += b.key_
+	f(prefix, member)
+	b.bitmap_.foreach(prefix, f)
+}
+func (b *bitmapM) foreach(prefix string, f func(string, Value)) {
+	f(prefix, member)
+	b.bitmap_.foreach(prefix, f)
+}
 func (b *bitmapKV) foreach(prefix string, f func(string, Value)) {
 	prefix += b.key_
 	f(prefix, b.val_)
@@ -415,15 +553,15 @@ func (b *bitmapK) foreach(prefix string, f func(string, Value)) {
 }
 func (b *bitmap_) foreach(prefix string, f func(string, Value)) {
 	b.withsubs(0, 256, func(cb byte, t itrie) {
-		t.foreach(prefix + string(cb), f)
+		t.foreach(prefix + cbstr[cb], f)
 	})
 }
 func (b *bitmap_) withsubs(start, end uint, f func(byte, itrie)) {
-	sw, sbit := bitpos(start); sw = min(sw, len(b.bm))
+	if start >= end || start >= 256 { return }
+	sw, sbit := bitpos(start)
 	index := b.indexOf(sw, sbit)
-	ew, ebit := bitpos(end); ew = min(ew, len(b.bm))
-	mw := ew + 1
-	if mw >= len(b.bm) { mw = len(b.bm)-1 }
+	ew, ebit := bitpos(end)
+	mw := min(ew + 1, len(b.bm))
 
 	for i, bm := range b.bm[sw:mw] {
 		w := i + sw
@@ -441,8 +579,32 @@ func (b *bitmap_) withsubs(start, end uint, f func(byte, itrie)) {
 		}
 	}
 }
+func (b *bitmap_) nextSub(cb uint) (byte, itrie) {
+	if cb >= 256 { return 0, nil }
+	c := byte(cb)
+	w, bit := bitpos(cb)
+	if !b.isset(w, bit) {
+		if c = b.firstAfter(c); c == byte(cb) { return 0, nil }
+		w, bit = bitpos(uint(c))
+	}
+	return c, b.sub[b.indexOf(w, bit)]
+}
+func (b *bitmap_) prevSub(cb uint) (byte, itrie) {
+	if cb == 0 { return 0, nil }
+	c := byte(min(int(cb), 256) - 1)
+	w, bit := bitpos(uint(c))
+	if !b.isset(w, bit) {
+		last := c
+		if c = b.lastBefore(c); c == last { return 0, nil }
+		w, bit = bitpos(uint(c))
+	}
+	return c, b.sub[b.indexOf(w, bit)]
+}
 func (b *bitmap_) count() int { return b.count_ }
+func (b *bitmap_) sum() int { return b.sum_ }
 func (b *bitmap_) occupied() int { return int(b.occupied_) }
+func (b *bitmap_) editor() *editor { return b.editor_ }
+func (b *bitmap_) setEditor(ed *editor) { b.editor_ = ed }
 func (b *bitmap_) expanse() expanse_t { return expanse(b.min(), b.max()) }
 func (b *bitmap_) expanseWithout(cb byte) expanse_t {
 	e := b.expanse()
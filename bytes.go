@@ -0,0 +1,33 @@
+package immutable
+
+import "unsafe"
+
+/*
+ Byte slice keys.
+
+ Lookups by byte slice view the slice as a string, without copying it, and go through the same
+ entryAt, findcb and splitKey as string keys.  That's only safe because a lookup never keeps
+ the key, or any part of it, once it returns.
+*/
+
+// The bytes of b as a string, sharing b's storage.  b mustn't change while the string is in use.
+func bytesKey(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+/*
+ Like Assoc, with the key taken from a byte slice.  The slice is copied once, and the trie's
+ nodes share that copy, so the caller may reuse the slice afterwards.
+*/
+func (d Dict) AssocBytes(key []byte, val Value) Dict {
+	t, _ := assoc(d.t, string(key), val, nil, true)
+	return Dict{t}
+}
+func (d Dict) ContainsBytes(key []byte) bool {
+	return entryAt(d.t, bytesKey(key)) != nil
+}
+func (d Dict) ValueAtBytes(key []byte) (Value, bool) {
+	e := entryAt(d.t, bytesKey(key))
+	if e != nil { return e.val(), true }
+	return nil, false
+}
@@ -0,0 +1,176 @@
+package immutable
+
+/*
+ Cursor
+
+ A Cursor walks the entries of a Dict in lexicographic key order, in either direction.  It
+ keeps the path from the root of the trie down to the current entry on an explicit stack, so
+ it needs no goroutine or channel, and since the trie it walks is immutable it stays valid
+ for as long as it is kept, whatever has been derived from its Dict since.
+
+ A new Cursor is unpositioned.  Next and Prev on an unpositioned Cursor behave like First and
+ Last, and a Cursor that steps off either end becomes unpositioned again.
+*/
+type Cursor struct {
+	root itrie
+	path []cursorFrame
+	buf []byte
+}
+
+/*
+ One node on the path to the current entry.  end is the length of the key up to the end of
+ t's own key, and cb is the critical byte followed out of t to the next frame.  cb is
+ meaningless for the last frame, whose value is the current entry.
+*/
+type cursorFrame struct {
+	t itrie
+	end int
+	cb byte
+}
+
+func (d Dict) Cursor() *Cursor {
+	return &Cursor{root: d.t}
+}
+func (c *Cursor) Valid() bool { return len(c.path) > 0 }
+func (c *Cursor) Key() string {
+	if len(c.path) == 0 { return "" }
+	return string(c.buf)
+}
+func (c *Cursor) Value() Value {
+	if len(c.path) == 0 { return nil }
+	return c.path[len(c.path)-1].t.val()
+}
+func (c *Cursor) reset() {
+	c.path = c.path[:0]
+	c.buf = c.buf[:0]
+}
+// Descends from t to the first entry beneath it.
+func (c *Cursor) leftmost(t itrie) {
+	for {
+		c.buf = append(c.buf, t.key()...)
+		if t.hasVal() {
+			c.path = append(c.path, cursorFrame{t, len(c.buf), 0})
+			return
+		}
+		cb, sub := t.nextSub(0)
+		c.path = append(c.path, cursorFrame{t, len(c.buf), cb})
+		c.buf = append(c.buf, cb)
+		t = sub
+	}
+}
+// Descends from t to the last entry beneath it.
+func (c *Cursor) rightmost(t itrie) {
+	for {
+		c.buf = append(c.buf, t.key()...)
+		cb, sub := t.prevSub(256)
+		c.path = append(c.path, cursorFrame{t, len(c.buf), cb})
+		if sub == nil { return }
+		c.buf = append(c.buf, cb)
+		t = sub
+	}
+}
+// Moves from the top frame to the first entry after everything beneath it.
+func (c *Cursor) ascend() bool {
+	for len(c.path) > 1 {
+		c.path = c.path[:len(c.path)-1]
+		top := &c.path[len(c.path)-1]
+		cb, sub := top.t.nextSub(uint(top.cb)+1)
+		if sub != nil {
+			top.cb = cb
+			c.buf = append(c.buf[:top.end], cb)
+			c.leftmost(sub)
+			return true
+		}
+	}
+	c.reset()
+	return false
+}
+func (c *Cursor) First() bool {
+	c.reset()
+	if c.root == nil { return false }
+	c.leftmost(c.root)
+	return true
+}
+func (c *Cursor) Last() bool {
+	c.reset()
+	if c.root == nil { return false }
+	c.rightmost(c.root)
+	return true
+}
+func (c *Cursor) Next() bool {
+	if len(c.path) == 0 { return c.First() }
+	// A node's own value sorts before everything beneath it.
+	top := &c.path[len(c.path)-1]
+	if cb, sub := top.t.nextSub(0); sub != nil {
+		top.cb = cb
+		c.buf = append(c.buf, cb)
+		c.leftmost(sub)
+		return true
+	}
+	return c.ascend()
+}
+func (c *Cursor) Prev() bool {
+	if len(c.path) == 0 { return c.Last() }
+	// The previous entry is the last one in an earlier sibling, or failing that the value of
+	// the parent itself.
+	for len(c.path) > 1 {
+		c.path = c.path[:len(c.path)-1]
+		top := &c.path[len(c.path)-1]
+		if cb, sub := top.t.prevSub(uint(top.cb)); sub != nil {
+			top.cb = cb
+			c.buf = append(c.buf[:top.end], cb)
+			c.rightmost(sub)
+			return true
+		}
+		if top.t.hasVal() {
+			c.buf = c.buf[:top.end]
+			return true
+		}
+	}
+	c.reset()
+	return false
+}
+/*
+ Positions the cursor at the first entry whose key is >= key, returning false (and leaving
+ the cursor unpositioned) if there is none.
+*/
+func (c *Cursor) Seek(key string) bool {
+	c.reset()
+	t := c.root
+	for t != nil {
+		key_ := t.key()
+		crit, match := findcb(key, key_)
+		if match {
+			c.leftmost(t)
+			return true
+		}
+		if crit < len(key_) {
+			if crit == len(key) || key[crit] < key_[crit] {
+				// everything beneath t sorts after key
+				c.leftmost(t)
+				return true
+			}
+			// everything beneath t sorts before key
+			c.buf = append(c.buf, key_...)
+			c.path = append(c.path, cursorFrame{t, len(c.buf), 0})
+			return c.ascend()
+		}
+		// t's key is a proper prefix of key, so t's own value sorts before it.
+		c.buf = append(c.buf, key_...)
+		cb := key[crit]
+		c.path = append(c.path, cursorFrame{t, len(c.buf), cb})
+		sub := t.subAt(cb)
+		if sub == nil {
+			next, sub := t.nextSub(uint(cb)+1)
+			if sub == nil { return c.ascend() }
+			c.path[len(c.path)-1].cb = next
+			c.buf = append(c.buf, next)
+			c.leftmost(sub)
+			return true
+		}
+		c.buf = append(c.buf, cb)
+		t = sub
+		key = key[crit+1:]
+	}
+	return false
+}
@@ -21,13 +21,48 @@ type Dict struct {
 	t itrie
 }
 func (d Dict) Assoc(key string, val Value) Dict {
-	t, _ := assoc(d.t, key, val)
+	t, _ := assoc(d.t, key, val, nil, false)
+	return Dict{t}
+}
+/*
+ Like Assoc, but the new nodes keep slices of key instead of copies.  Only for a key that isn't
+ a slice of some larger string, which the Dict would otherwise keep alive.
+*/
+func (d Dict) AssocNoCopy(key string, val Value) Dict {
+	t, _ := assoc(d.t, key, val, nil, true)
 	return Dict{t}
 }
 func (d Dict) Without(key string) Dict {
-	t, _ := without(d.t, key)
+	t, _ := without(d.t, key, nil)
 	return Dict{t}
 }
+/*
+ Like Assoc, but also returns the value key had before, and whether it had one (in which case
+ the value was replaced rather than added).
+*/
+func (d Dict) AssocReport(key string, val Value) (r Dict, old Value, replaced bool) {
+	r.t = update(d.t, key, func(v Value, present bool) (Value, bool) {
+		old, replaced = v, present
+		return val, true
+	})
+	return
+}
+// Like Without, but also returns the value removed, and whether there was one.
+func (d Dict) WithoutReport(key string) (r Dict, old Value, removed bool) {
+	r.t = update(d.t, key, func(v Value, present bool) (Value, bool) {
+		old, removed = v, present
+		return nil, false
+	})
+	return
+}
+/*
+ Calls fn with the value at key and whether key is present, and returns the Dict with key set
+ to the value fn returns, or removed if fn returns keep false.  The key is found only once.
+ If fn changes nothing, by returning the very value that was there, d itself is returned.
+*/
+func (d Dict) Update(key string, fn func(old Value, present bool) (val Value, keep bool)) Dict {
+	return Dict{update(d.t, key, fn)}
+}
 func (d Dict) Contains(key string) bool { 
 	e := entryAt(d.t, key)
 	return e != nil
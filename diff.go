@@ -0,0 +1,137 @@
+package immutable
+
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota
+	Removed
+	Changed
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added: return "Added"
+	case Removed: return "Removed"
+	case Changed: return "Changed"
+	}
+	return "ChangeKind(?)"
+}
+
+// Whether v is of one of the basic types, whose values == compares without panicking.
+func basic(v Value) bool {
+	switch v.(type) {
+	case nil, string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		uintptr, float32, float64, complex64, complex128, multiplicity:
+		return true
+	}
+	return false
+}
+/*
+ Whether two values are the same.  Values of the basic types are compared with ==; anything else
+ (a slice or a struct, say) is the same only if both are copies of one stored value, as when one
+ Dict was derived from the other and the entry was left alone.
+*/
+func sameValue(a, b Value) bool {
+	if basic(a) && basic(b) { return a == b }
+	return identical(a, b)
+}
+
+// Calls fn for each entry beneath t, taking t's key to be key.
+func foreachAs(t itrie, key string, prefix string, fn func(string, Value)) {
+	prefix += key
+	if t.hasVal() { fn(prefix, t.val()) }
+	t.withsubs(0, 256, func(cb byte, sub itrie) { sub.foreach(prefix + cbstr[cb], fn) })
+}
+
+type diffFn func(string, ChangeKind, Value, Value)
+
+func added(b itrie, kb string, prefix string, fn diffFn) {
+	foreachAs(b, kb, prefix, func(key string, val Value) { fn(key, Added, nil, val) })
+}
+func removed(a itrie, ka string, prefix string, fn diffFn) {
+	foreachAs(a, ka, prefix, func(key string, val Value) { fn(key, Removed, val, nil) })
+}
+
+/*
+ Reports the differences between a and b in key order.  As in merge, ka and kb are the keys a
+ and b are to be taken to have.
+*/
+func diff(a itrie, ka string, b itrie, kb string, prefix string, fn diffFn) {
+	if a == nil {
+		if b != nil { added(b, kb, prefix, fn) }
+		return
+	}
+	if b == nil { removed(a, ka, prefix, fn); return }
+	if a == b && ka == kb { return }
+
+	crit, match := findcb(ka, kb)
+	switch {
+	case match:
+		key := prefix + ka
+		switch {
+		case a.hasVal() && b.hasVal():
+			if !sameValue(a.val(), b.val()) { fn(key, Changed, a.val(), b.val()) }
+		case a.hasVal():
+			fn(key, Removed, a.val(), nil)
+		case b.hasVal():
+			fn(key, Added, nil, b.val())
+		}
+		acbs, asubs := subsOf(a)
+		bcbs, bsubs := subsOf(b)
+		i, j := 0, 0
+		for i < len(acbs) || j < len(bcbs) {
+			switch {
+			case j == len(bcbs) || (i < len(acbs) && acbs[i] < bcbs[j]):
+				removed(asubs[i], asubs[i].key(), key + cbstr[acbs[i]], fn); i++
+			case i == len(acbs) || bcbs[j] < acbs[i]:
+				added(bsubs[j], bsubs[j].key(), key + cbstr[bcbs[j]], fn); j++
+			default:
+				diff(asubs[i], asubs[i].key(), bsubs[j], bsubs[j].key(), key + cbstr[acbs[i]], fn)
+				i++; j++
+			}
+		}
+	case crit == len(ka):
+		// b lies beneath a, at cb
+		key := prefix + ka
+		if a.hasVal() { fn(key, Removed, a.val(), nil) }
+		cb := kb[crit]
+		a.withsubs(0, uint(cb), func(c byte, sub itrie) { removed(sub, sub.key(), key + cbstr[c], fn) })
+		if sub := a.subAt(cb); sub != nil {
+			diff(sub, sub.key(), b, kb[crit+1:], key + cbstr[cb], fn)
+		} else {
+			added(b, kb[crit+1:], key + cbstr[cb], fn)
+		}
+		a.withsubs(uint(cb)+1, 256, func(c byte, sub itrie) { removed(sub, sub.key(), key + cbstr[c], fn) })
+	case crit == len(kb):
+		// a lies beneath b, at cb
+		key := prefix + kb
+		if b.hasVal() { fn(key, Added, nil, b.val()) }
+		cb := ka[crit]
+		b.withsubs(0, uint(cb), func(c byte, sub itrie) { added(sub, sub.key(), key + cbstr[c], fn) })
+		if sub := b.subAt(cb); sub != nil {
+			diff(a, ka[crit+1:], sub, sub.key(), key + cbstr[cb], fn)
+		} else {
+			removed(a, ka[crit+1:], key + cbstr[cb], fn)
+		}
+		b.withsubs(uint(cb)+1, 256, func(c byte, sub itrie) { added(sub, sub.key(), key + cbstr[c], fn) })
+	case ka[crit] < kb[crit]:
+		removed(a, ka, prefix, fn)
+		added(b, kb, prefix, fn)
+	default:
+		added(b, kb, prefix, fn)
+		removed(a, ka, prefix, fn)
+	}
+}
+
+/*
+ Calls fn, in key order, for each key whose entry differs between old and new: with Added and
+ the new value, Removed and the old value, or Changed and both.  Sub-tries the two versions
+ share are skipped without being looked into, so when one was derived from the other the cost
+ is proportional to the size of the change, not of the Dicts.
+*/
+func Diff(old, new Dict, fn func(key string, kind ChangeKind, oldVal, newVal Value)) {
+	var ka, kb string
+	if old.t != nil { ka = old.t.key() }
+	if new.t != nil { kb = new.t.key() }
+	diff(old.t, ka, new.t, kb, "", fn)
+}
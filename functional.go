@@ -0,0 +1,88 @@
+package immutable
+
+/*
+ Calls fn for each entry beneath t in key order, with t's own key preceded by prefix, until fn
+ returns false.  Returns false if it was stopped.
+*/
+func visit(t itrie, prefix string, fn func(string, Value) bool) bool {
+	prefix += t.key()
+	if t.hasVal() && !fn(prefix, t.val()) { return false }
+	for cb, sub := t.nextSub(0); sub != nil; cb, sub = t.nextSub(uint(cb)+1) {
+		if !visit(sub, prefix + cbstr[cb], fn) { return false }
+	}
+	return true
+}
+
+// The entries beneath t for which pred holds.  Sub-tries whose entries all pass are reused.
+func filter(t itrie, prefix string, pred func(string, Value) bool) itrie {
+	prefix += t.key()
+	full := t.hasVal() && pred(prefix, t.val())
+	changed := full != t.hasVal()
+	var cbs []byte
+	var subs []itrie
+	t.withsubs(0, 256, func(cb byte, sub itrie) {
+		r := filter(sub, prefix + cbstr[cb], pred)
+		if r != sub { changed = true }
+		if r != nil { cbs = append(cbs, cb); subs = append(subs, r) }
+	})
+	if !changed { return t }
+	return makeNode(t.key(), t.val(), full, cbs, subs)
+}
+
+/*
+ A node of the same kind and shape as t, with val in place of t's value, if it has one, and
+ subs in place of its sub-tries, in order.  The counts of subs must be those of t's sub-tries.
+*/
+func cloneShape(t itrie, val Value, subs []itrie) itrie {
+	if t.occupied() == 0 { return leafOwning(t.key(), val) }
+	var r itrie
+	i := 0
+	t.withsubs(0, 256, func(cb byte, sub itrie) {
+		// The first sub-trie makes the copy, and the rest are set in it in place.
+		if r == nil {
+			r = t.with(0, cb, subs[i])
+		} else {
+			r.setSub(0, subs[i].sum() - sub.sum(), cb, subs[i])
+		}
+		i++
+	})
+	if t.hasVal() { r.setVal(val) }
+	return r
+}
+
+// t, with the same keys and each value replaced by what fn returns for it.
+func mapValues(t itrie, prefix string, fn func(string, Value) Value) itrie {
+	prefix += t.key()
+	var val Value
+	if t.hasVal() { val = fn(prefix, t.val()) }
+	cbs, subs := subsOf(t)
+	for i, sub := range subs { subs[i] = mapValues(sub, prefix + cbstr[cbs[i]], fn) }
+	return cloneShape(t, val, subs)
+}
+
+// Returns the Dict holding just the entries of d for which pred returns true.
+func (d Dict) Filter(pred func(key string, val Value) bool) Dict {
+	if d.t == nil { return d }
+	return Dict{filter(d.t, "", pred)}
+}
+// Returns a Dict with the same keys as d, where each value is fn's result for d's entry.
+func (d Dict) MapValues(fn func(key string, val Value) Value) Dict {
+	if d.t == nil { return d }
+	return Dict{mapValues(d.t, "", fn)}
+}
+// Folds fn over the entries of d in key order, starting from init.
+func (d Dict) Reduce(init Value, fn func(acc Value, key string, val Value) Value) Value {
+	acc := init
+	d.Foreach(func(key string, val Value) { acc = fn(acc, key, val) })
+	return acc
+}
+// Whether pred holds for any entry of d.  Stops at the first one it holds for.
+func (d Dict) Any(pred func(key string, val Value) bool) bool {
+	if d.t == nil { return false }
+	return !visit(d.t, "", func(key string, val Value) bool { return !pred(key, val) })
+}
+// Whether pred holds for every entry of d.  Stops at the first one it fails for.
+func (d Dict) All(pred func(key string, val Value) bool) bool {
+	if d.t == nil { return true }
+	return visit(d.t, "", pred)
+}
@@ -0,0 +1,482 @@
+package immutable
+
+import "math"
+import "unsafe"
+import "runtime"
+
+/*
+ HashDict
+
+ A HashDict is a Dict whose keys may be strings, numbers or booleans, which are compared with
+ ==, or of any type that implements Hashable, whose keys are compared with Equal instead.  A key
+ of any other type panics; wrap pointers, arrays and structs in a Hashable to use them as keys.
+ Keys of different types are different keys, even when they hash the same.  Go has no type
+ parameters, so a HashDict can't be a HashDict[K comparable, V any]: as with a Dict's values,
+ the keys are Values and callers assert their types.
+
+ The trie is keyed on the 64-bit hash of each key, a byte at a time from the lowest, in nodes
+ that use the same bitset and variable-size layout as a bitmap.  Each key and value sits in a
+ leaf of its own, as high in the trie as the hashes of the other keys allow, and keys whose
+ hashes are the same share a collision node.  A HashDict has no order: Foreach, Iter and a
+ HashCursor all visit the entries in the same order, but that order comes from the hashes of
+ the keys rather than from the keys themselves.
+*/
+type HashDict struct {
+	t hnode
+}
+
+type HashItem struct {
+	key Value
+	val Value
+}
+
+/*
+ A key that hashes and compares itself, and so needn't be comparable with ==.  Keys that are
+ Equal must have the same Hash.  Equal may be given a key of any type, and must be false for
+ one of a type other than its own.
+*/
+type Hashable interface {
+	Hash() uint64
+	Equal(other Value) bool
+}
+
+const fnvOffset = 14695981039346656037
+const fnvPrime = 1099511628211
+
+// The finalizer of MurmurHash3, to spread the bits of integer keys across the whole hash.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+// FNV-1a
+func hashString(s string) uint64 {
+	h := uint64(fnvOffset)
+	for i := 0; i < len(s); i++ { h = (h ^ uint64(s[i])) * fnvPrime }
+	return h
+}
+func hashFloat(f float64) uint64 {
+	if f == 0 { f = 0 }	// -0 == 0
+	return mix(math.Float64bits(f))
+}
+// Hashes key by what == compares, so that keys that are == hash the same.
+func hashOf(key Value) uint64 {
+	switch k := key.(type) {
+	case Hashable: return k.Hash()
+	case string: return hashString(k)
+	case int: return mix(uint64(k))
+	case int8: return mix(uint64(k))
+	case int16: return mix(uint64(k))
+	case int32: return mix(uint64(k))
+	case int64: return mix(uint64(k))
+	case uint: return mix(uint64(k))
+	case uint8: return mix(uint64(k))
+	case uint16: return mix(uint64(k))
+	case uint32: return mix(uint64(k))
+	case uint64: return mix(k)
+	case uintptr: return mix(uint64(k))
+	case float32: return hashFloat(float64(k))
+	case float64: return hashFloat(k)
+	case complex64: return (hashFloat(float64(real(k))) ^ hashFloat(float64(imag(k)))) * fnvPrime
+	case complex128: return (hashFloat(real(k)) ^ hashFloat(imag(k))) * fnvPrime
+	case bool:
+		if k { return mix(1) }
+		return mix(0)
+	}
+	panic("HashDict keys must be strings, numbers, booleans or Hashable")
+}
+// Whether key, being looked for, is the key k_ already in the trie.
+func keysEqual(key, k_ Value) bool {
+	if k, ok := key.(Hashable); ok { return k.Equal(k_) }
+	return key == k_
+}
+
+/*
+ hnode
+
+ The interface of the nodes of a HashDict's trie.  shift is the position in the hash of the
+ byte that picks a node's sub-trie; a leaf or collision node doesn't depend on where it is.
+ update calls fn once, with the value at key and whether key is present, and makes the change
+ it asks for, as update does for a Dict, returning the node that takes this one's place and the
+ number of keys that adds (1, 0 or -1).
+*/
+type hnode interface {
+	find(h uint64, shift uint, key Value) (Value, bool)
+	assoc(h uint64, shift uint, key, val Value) (hnode, int)
+	without(h uint64, shift uint, key Value) (hnode, int)
+	update(h uint64, shift uint, key Value, fn func(Value, bool) (Value, bool)) (hnode, int)
+	count() int
+	foreach(f func(Value, Value))
+	// The nodes beneath this one, in order: the sub-tries of a bitmap, or the leaves of a
+	// collision node.
+	occupied() int
+	child(i int) hnode
+}
+
+type hleaf struct {
+	hash_ uint64
+	key Value
+	val Value
+}
+type hcollision struct {
+	hash_ uint64
+	leaves []*hleaf
+}
+type hbitmap struct {
+	bitset
+	occupied_ uint16
+	count_ int
+	sub [256]hnode		// We don't actually allocate 256 entries
+}
+
+var sizeofHbitmap uintptr
+
+func init() {
+	var b hbitmap
+	sizeofHbitmap = uintptr(unsafe.Sizeof(b)) - 256*uintptr(unsafe.Sizeof(b.sub[0]))
+}
+
+func newHbitmap(size uint16) *hbitmap {
+	asize := uintptr(unsafe.Sizeof(hnode(nil)))*uintptr(size)+sizeofHbitmap
+	b := (*hbitmap)(unsafe.Pointer(runtime.Alloc(asize)))
+	b.occupied_ = size
+	return b
+}
+// The node at shift holding both a, whose keys hash to ha, and b, whose keys hash to hb.
+func hpair(shift uint, ha uint64, a hnode, hb uint64, b hnode) hnode {
+	ca, cb := byte(ha >> shift), byte(hb >> shift)
+	if ca == cb {
+		n := newHbitmap(1)
+		n.setbit(bitpos(uint(ca)))
+		n.sub[0] = hpair(shift+8, ha, a, hb, b)
+		n.count_ = a.count() + b.count()
+		return n
+	}
+	if cb < ca { ca, cb = cb, ca; a, b = b, a }
+	n := newHbitmap(2)
+	n.setbit(bitpos(uint(ca))); n.setbit(bitpos(uint(cb)))
+	n.sub[0] = a; n.sub[1] = b
+	n.count_ = a.count() + b.count()
+	return n
+}
+
+func (l *hleaf) find(h uint64, shift uint, key Value) (Value, bool) {
+	if h == l.hash_ && keysEqual(key, l.key) { return l.val, true }
+	return nil, false
+}
+// The node holding both l and key, which isn't l's key.
+func (l *hleaf) add(h uint64, shift uint, key, val Value) hnode {
+	if h != l.hash_ { return hpair(shift, l.hash_, l, h, &hleaf{h, key, val}) }
+	return &hcollision{h, []*hleaf{l, &hleaf{h, key, val}}}
+}
+func (l *hleaf) assoc(h uint64, shift uint, key, val Value) (hnode, int) {
+	if h != l.hash_ || !keysEqual(key, l.key) { return l.add(h, shift, key, val), 1 }
+	if identical(val, l.val) { return l, 0 }
+	return &hleaf{h, key, val}, 0
+}
+func (l *hleaf) without(h uint64, shift uint, key Value) (hnode, int) {
+	if h == l.hash_ && keysEqual(key, l.key) { return nil, -1 }
+	return l, 0
+}
+func (l *hleaf) update(h uint64, shift uint, key Value, fn func(Value, bool) (Value, bool)) (hnode, int) {
+	if h != l.hash_ || !keysEqual(key, l.key) {
+		val, keep := fn(nil, false)
+		if !keep { return l, 0 }
+		return l.add(h, shift, key, val), 1
+	}
+	val, keep := fn(l.val, true)
+	if !keep { return nil, -1 }
+	if identical(val, l.val) { return l, 0 }
+	return &hleaf{h, l.key, val}, 0
+}
+func (l *hleaf) count() int { return 1 }
+func (l *hleaf) foreach(f func(Value, Value)) { f(l.key, l.val) }
+func (l *hleaf) occupied() int { return 0 }
+func (l *hleaf) child(i int) hnode { return nil }
+
+func (c *hcollision) indexOf(key Value) int {
+	for i, l := range c.leaves {
+		if keysEqual(key, l.key) { return i }
+	}
+	return -1
+}
+// c with l in place of its i'th leaf, or added to its leaves if i is len(c.leaves).
+func (c *hcollision) withLeaf(i int, l *hleaf) *hcollision {
+	n := &hcollision{c.hash_, make([]*hleaf, len(c.leaves), len(c.leaves)+1)}
+	copy(n.leaves, c.leaves)
+	if i == len(c.leaves) { n.leaves = append(n.leaves, l) } else { n.leaves[i] = l }
+	return n
+}
+// c without its i'th leaf, which is all that's left of it if c only had one other.
+func (c *hcollision) withoutLeaf(i int) hnode {
+	if len(c.leaves) == 2 { return c.leaves[1-i] }
+	n := &hcollision{c.hash_, make([]*hleaf, 0, len(c.leaves)-1)}
+	n.leaves = append(n.leaves, c.leaves[:i]...)
+	n.leaves = append(n.leaves, c.leaves[i+1:]...)
+	return n
+}
+func (c *hcollision) find(h uint64, shift uint, key Value) (Value, bool) {
+	if h != c.hash_ { return nil, false }
+	if i := c.indexOf(key); i >= 0 { return c.leaves[i].val, true }
+	return nil, false
+}
+func (c *hcollision) assoc(h uint64, shift uint, key, val Value) (hnode, int) {
+	if h != c.hash_ { return hpair(shift, c.hash_, c, h, &hleaf{h, key, val}), 1 }
+	i := c.indexOf(key)
+	if i < 0 { return c.withLeaf(len(c.leaves), &hleaf{h, key, val}), 1 }
+	if identical(val, c.leaves[i].val) { return c, 0 }
+	return c.withLeaf(i, &hleaf{h, key, val}), 0
+}
+func (c *hcollision) without(h uint64, shift uint, key Value) (hnode, int) {
+	i := -1
+	if h == c.hash_ { i = c.indexOf(key) }
+	if i < 0 { return c, 0 }
+	return c.withoutLeaf(i), -1
+}
+func (c *hcollision) update(h uint64, shift uint, key Value, fn func(Value, bool) (Value, bool)) (hnode, int) {
+	i := -1
+	if h == c.hash_ { i = c.indexOf(key) }
+	if i < 0 {
+		val, keep := fn(nil, false)
+		if !keep { return c, 0 }
+		if h != c.hash_ { return hpair(shift, c.hash_, c, h, &hleaf{h, key, val}), 1 }
+		return c.withLeaf(len(c.leaves), &hleaf{h, key, val}), 1
+	}
+	l := c.leaves[i]
+	val, keep := fn(l.val, true)
+	if !keep { return c.withoutLeaf(i), -1 }
+	if identical(val, l.val) { return c, 0 }
+	return c.withLeaf(i, &hleaf{h, l.key, val}), 0
+}
+func (c *hcollision) count() int { return len(c.leaves) }
+func (c *hcollision) foreach(f func(Value, Value)) {
+	for _, l := range c.leaves { f(l.key, l.val) }
+}
+func (c *hcollision) occupied() int { return len(c.leaves) }
+func (c *hcollision) child(i int) hnode { return c.leaves[i] }
+
+func (b *hbitmap) find(h uint64, shift uint, key Value) (Value, bool) {
+	w, bit := bitpos(uint(byte(h >> shift)))
+	if !b.isset(w, bit) { return nil, false }
+	return b.sub[b.indexOf(w, bit)].find(h, shift+8, key)
+}
+// b with the leaf l as a new sub-trie, at the byte of its hash that maps to w and bit.
+func (b *hbitmap) insert(w int, bit uint64, l *hleaf) *hbitmap {
+	i := b.indexOf(w, bit)
+	n := newHbitmap(b.occupied_+1)
+	n.bitset = b.bitset; n.setbit(w, bit)
+	copy(n.sub[:i], b.sub[:i])
+	n.sub[i] = l
+	copy(n.sub[i+1:n.occupied_], b.sub[i:b.occupied_])
+	n.count_ = b.count_ + 1
+	return n
+}
+func (b *hbitmap) modify(incr, i int, r hnode) *hbitmap {
+	n := newHbitmap(b.occupied_)
+	n.bitset = b.bitset
+	copy(n.sub[:n.occupied_], b.sub[:b.occupied_])
+	n.sub[i] = r; n.count_ = b.count_ + incr
+	return n
+}
+/*
+ b with r in place of its sub-trie at w and bit, which holds incr more keys than that did.  r
+ may be nil.  Whatever is left of b moves up in its place if it's just a leaf or collision node.
+*/
+func (b *hbitmap) replace(w int, bit uint64, r hnode, incr int) hnode {
+	i := b.indexOf(w, bit)
+	if r != nil {
+		if _, ok := r.(*hbitmap); !ok && b.occupied_ == 1 { return r }
+		return b.modify(incr, i, r)
+	}
+	if b.occupied_ == 2 {
+		if _, ok := b.sub[1-i].(*hbitmap); !ok { return b.sub[1-i] }
+	}
+	n := newHbitmap(b.occupied_-1)
+	n.bitset = b.bitset; n.clearbit(w, bit)
+	copy(n.sub[:i], b.sub[:i])
+	copy(n.sub[i:n.occupied_], b.sub[i+1:b.occupied_])
+	n.count_ = b.count_ + incr
+	return n
+}
+func (b *hbitmap) assoc(h uint64, shift uint, key, val Value) (hnode, int) {
+	w, bit := bitpos(uint(byte(h >> shift)))
+	if !b.isset(w, bit) { return b.insert(w, bit, &hleaf{h, key, val}), 1 }
+	sub := b.sub[b.indexOf(w, bit)]
+	r, added := sub.assoc(h, shift+8, key, val)
+	if r == sub { return b, 0 }
+	return b.replace(w, bit, r, added), added
+}
+func (b *hbitmap) without(h uint64, shift uint, key Value) (hnode, int) {
+	w, bit := bitpos(uint(byte(h >> shift)))
+	if !b.isset(w, bit) { return b, 0 }
+	sub := b.sub[b.indexOf(w, bit)]
+	r, added := sub.without(h, shift+8, key)
+	if r == sub { return b, 0 }
+	return b.replace(w, bit, r, added), added
+}
+func (b *hbitmap) update(h uint64, shift uint, key Value, fn func(Value, bool) (Value, bool)) (hnode, int) {
+	w, bit := bitpos(uint(byte(h >> shift)))
+	if !b.isset(w, bit) {
+		val, keep := fn(nil, false)
+		if !keep { return b, 0 }
+		return b.insert(w, bit, &hleaf{h, key, val}), 1
+	}
+	sub := b.sub[b.indexOf(w, bit)]
+	r, added := sub.update(h, shift+8, key, fn)
+	if r == sub { return b, 0 }
+	return b.replace(w, bit, r, added), added
+}
+func (b *hbitmap) count() int { return b.count_ }
+func (b *hbitmap) foreach(f func(Value, Value)) {
+	for _, sub := range b.sub[:b.occupied_] { sub.foreach(f) }
+}
+func (b *hbitmap) occupied() int { return int(b.occupied_) }
+func (b *hbitmap) child(i int) hnode { return b.sub[i] }
+
+func (d HashDict) Assoc(key, val Value) HashDict {
+	h := hashOf(key)
+	if d.t == nil { return HashDict{&hleaf{h, key, val}} }
+	t, _ := d.t.assoc(h, 0, key, val)
+	return HashDict{t}
+}
+func (d HashDict) Without(key Value) HashDict {
+	if d.t == nil { return d }
+	t, _ := d.t.without(hashOf(key), 0, key)
+	return HashDict{t}
+}
+/*
+ Calls fn with the value at key and whether key is present, and returns the HashDict with key
+ set to the value fn returns, or removed if fn returns keep false.  The key is found only once.
+ If fn changes nothing, by returning the very value that was there, d itself is returned.
+*/
+func (d HashDict) Update(key Value, fn func(old Value, present bool) (val Value, keep bool)) HashDict {
+	h := hashOf(key)
+	if d.t == nil {
+		val, keep := fn(nil, false)
+		if !keep { return d }
+		return HashDict{&hleaf{h, key, val}}
+	}
+	t, _ := d.t.update(h, 0, key, fn)
+	return HashDict{t}
+}
+/*
+ Like Assoc, but also returns the value key had before, and whether it had one (in which case
+ the value was replaced rather than added).
+*/
+func (d HashDict) AssocReport(key, val Value) (r HashDict, old Value, replaced bool) {
+	r = d.Update(key, func(v Value, present bool) (Value, bool) {
+		old, replaced = v, present
+		return val, true
+	})
+	return
+}
+// Like Without, but also returns the value removed, and whether there was one.
+func (d HashDict) WithoutReport(key Value) (r HashDict, old Value, removed bool) {
+	r = d.Update(key, func(v Value, present bool) (Value, bool) {
+		old, removed = v, present
+		return nil, false
+	})
+	return
+}
+func (d HashDict) Contains(key Value) bool {
+	_, ok := d.ValueAt(key)
+	return ok
+}
+func (d HashDict) ValueAt(key Value) (Value, bool) {
+	if d.t == nil { return nil, false }
+	return d.t.find(hashOf(key), 0, key)
+}
+func (d HashDict) Count() int {
+	if d.t != nil { return d.t.count() }
+	return 0
+}
+// Calls fn for each entry, in no particular order.
+func (d HashDict) Foreach(fn func(key, val Value)) {
+	if d.t != nil { d.t.foreach(fn) }
+}
+func (d HashDict) Iter() chan HashItem {
+	ch := make(chan HashItem)
+	go func() {
+		d.Foreach(func(key, val Value) { ch <- HashItem{key, val} })
+		close(ch)
+	}()
+	return ch
+}
+
+/*
+ HashCursor
+
+ A HashCursor walks the entries of a HashDict in either direction, in the order Foreach visits
+ them, keeping the path down to the current entry on an explicit stack as a Cursor does.  A new
+ HashCursor is unpositioned, and Next, Prev and stepping off either end work as for a Cursor.
+*/
+type HashCursor struct {
+	root hnode
+	path []hashFrame
+}
+// One node on the path to the current entry, and the node beneath it that the path follows.
+type hashFrame struct {
+	n hnode
+	i int
+}
+
+func (d HashDict) Cursor() *HashCursor {
+	return &HashCursor{root: d.t}
+}
+func (c *HashCursor) Valid() bool { return len(c.path) > 0 }
+func (c *HashCursor) leaf() *hleaf { return c.path[len(c.path)-1].n.(*hleaf) }
+func (c *HashCursor) Key() Value {
+	if len(c.path) == 0 { return nil }
+	return c.leaf().key
+}
+func (c *HashCursor) Value() Value {
+	if len(c.path) == 0 { return nil }
+	return c.leaf().val
+}
+// Descends from n to the first entry beneath it, or the last if last is set.
+func (c *HashCursor) descend(n hnode, last bool) {
+	for n.occupied() > 0 {
+		i := 0
+		if last { i = n.occupied()-1 }
+		c.path = append(c.path, hashFrame{n, i})
+		n = n.child(i)
+	}
+	c.path = append(c.path, hashFrame{n, 0})
+}
+// Moves to the next entry (or the previous, for a step of -1) after everything beneath the top.
+func (c *HashCursor) step(by int) bool {
+	for len(c.path) > 1 {
+		c.path = c.path[:len(c.path)-1]
+		top := &c.path[len(c.path)-1]
+		if i := top.i + by; i >= 0 && i < top.n.occupied() {
+			top.i = i
+			c.descend(top.n.child(i), by < 0)
+			return true
+		}
+	}
+	c.path = c.path[:0]
+	return false
+}
+func (c *HashCursor) First() bool {
+	c.path = c.path[:0]
+	if c.root == nil { return false }
+	c.descend(c.root, false)
+	return true
+}
+func (c *HashCursor) Last() bool {
+	c.path = c.path[:0]
+	if c.root == nil { return false }
+	c.descend(c.root, true)
+	return true
+}
+func (c *HashCursor) Next() bool {
+	if len(c.path) == 0 { return c.First() }
+	return c.step(1)
+}
+func (c *HashCursor) Prev() bool {
+	if len(c.path) == 0 { return c.Last() }
+	return c.step(-1)
+}
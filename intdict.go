@@ -0,0 +1,109 @@
+package immutable
+
+/*
+ IntDict
+
+ An IntDict is a Dict keyed by uint64.  Each key is stored as its 8 bytes, most significant
+ first, so that key order is numeric order, and IDs that are close together share all but
+ their last byte or two, where they fill dense span and bitmap nodes.  Int64Dict does the same
+ for int64 keys, with the sign bit flipped so that negative keys sort first.
+*/
+type IntDict struct {
+	d Dict
+}
+type Int64Dict struct {
+	u IntDict
+}
+
+func encodeUint(k uint64, b *[8]byte) []byte {
+	for i := 7; i >= 0; i-- { b[i] = byte(k); k >>= 8 }
+	return b[:]
+}
+func encodeUintString(k uint64) string {
+	var b [8]byte
+	return string(encodeUint(k, &b))
+}
+func decodeUint(key string) uint64 {
+	var k uint64
+	for i := 0; i < 8; i++ { k = k<<8 | uint64(key[i]) }
+	return k
+}
+func withUint(fn func(uint64, Value)) func(string, Value) {
+	return func(key string, val Value) { fn(decodeUint(key), val) }
+}
+func uintEntry(key string, val Value, ok bool) (uint64, Value, bool) {
+	if !ok { return 0, nil, false }
+	return decodeUint(key), val, true
+}
+
+func (d IntDict) Assoc(key uint64, val Value) IntDict {
+	var b [8]byte
+	return IntDict{d.d.AssocBytes(encodeUint(key, &b), val)}
+}
+func (d IntDict) Without(key uint64) IntDict {
+	return IntDict{d.d.Without(encodeUintString(key))}
+}
+func (d IntDict) Contains(key uint64) bool {
+	var b [8]byte
+	return d.d.ContainsBytes(encodeUint(key, &b))
+}
+func (d IntDict) ValueAt(key uint64) (Value, bool) {
+	var b [8]byte
+	return d.d.ValueAtBytes(encodeUint(key, &b))
+}
+func (d IntDict) Count() int { return d.d.Count() }
+// Calls fn for each entry, in numeric order of the keys.
+func (d IntDict) Foreach(fn func(uint64, Value)) { d.d.Foreach(withUint(fn)) }
+// Calls fn for each entry with lo <= key <= hi, in numeric order of the keys.
+func (d IntDict) Range(lo, hi uint64, fn func(uint64, Value)) {
+	if lo > hi { return }
+	// Every key is 8 bytes long, so hi's encoding followed by anything covers hi itself.
+	d.d.Range(encodeUintString(lo), encodeUintString(hi) + "\x00", withUint(fn))
+}
+func (d IntDict) Floor(key uint64) (uint64, Value, bool) {
+	return uintEntry(d.d.Floor(encodeUintString(key)))
+}
+func (d IntDict) Ceiling(key uint64) (uint64, Value, bool) {
+	return uintEntry(d.d.Ceiling(encodeUintString(key)))
+}
+func (d IntDict) Lower(key uint64) (uint64, Value, bool) {
+	return uintEntry(d.d.Lower(encodeUintString(key)))
+}
+func (d IntDict) Higher(key uint64) (uint64, Value, bool) {
+	return uintEntry(d.d.Higher(encodeUintString(key)))
+}
+func (d IntDict) Min() (uint64, Value, bool) { return uintEntry(d.d.Min()) }
+func (d IntDict) Max() (uint64, Value, bool) { return uintEntry(d.d.Max()) }
+
+const signBit = 1 << 63
+
+func toUint(k int64) uint64 { return uint64(k) ^ signBit }
+func withInt(fn func(int64, Value)) func(uint64, Value) {
+	return func(key uint64, val Value) { fn(int64(key ^ signBit), val) }
+}
+func intEntry(key uint64, val Value, ok bool) (int64, Value, bool) {
+	if !ok { return 0, nil, false }
+	return int64(key ^ signBit), val, true
+}
+
+func (d Int64Dict) Assoc(key int64, val Value) Int64Dict {
+	return Int64Dict{d.u.Assoc(toUint(key), val)}
+}
+func (d Int64Dict) Without(key int64) Int64Dict {
+	return Int64Dict{d.u.Without(toUint(key))}
+}
+func (d Int64Dict) Contains(key int64) bool { return d.u.Contains(toUint(key)) }
+func (d Int64Dict) ValueAt(key int64) (Value, bool) { return d.u.ValueAt(toUint(key)) }
+func (d Int64Dict) Count() int { return d.u.Count() }
+// Calls fn for each entry, in numeric order of the keys.
+func (d Int64Dict) Foreach(fn func(int64, Value)) { d.u.Foreach(withInt(fn)) }
+// Calls fn for each entry with lo <= key <= hi, in numeric order of the keys.
+func (d Int64Dict) Range(lo, hi int64, fn func(int64, Value)) {
+	d.u.Range(toUint(lo), toUint(hi), withInt(fn))
+}
+func (d Int64Dict) Floor(key int64) (int64, Value, bool) { return intEntry(d.u.Floor(toUint(key))) }
+func (d Int64Dict) Ceiling(key int64) (int64, Value, bool) { return intEntry(d.u.Ceiling(toUint(key))) }
+func (d Int64Dict) Lower(key int64) (int64, Value, bool) { return intEntry(d.u.Lower(toUint(key))) }
+func (d Int64Dict) Higher(key int64) (int64, Value, bool) { return intEntry(d.u.Higher(toUint(key))) }
+func (d Int64Dict) Min() (int64, Value, bool) { return intEntry(d.u.Min()) }
+func (d Int64Dict) Max() (int64, Value, bool) { return intEntry(d.u.Max()) }
@@ -3,48 +3,88 @@ package immutable
 /*
  leaf_t
 
- Internal node that contains only a key and a value.
+ Internal node that contains only a key and a value.  The methods that don't depend on the
+ value belong to leaf_, which the leaf variants share.
 */
+type leaf_ struct {}
 type leafV struct {
+	leaf_
 	entryV
 }
 type leafKV struct {
 	key_ string
 	leafV
 }
+type leafM struct {
+	leaf_
+	entryM
+}
+type leafKM struct {
+	key_ string
+	leafM
+}
 
 func leaf(key string, val Value) itrie {
+	return leafOwning(str(key), val)
+}
+// Like leaf, but the leaf keeps key itself rather than a copy.
+func leafOwning(key string, val Value) itrie {
+	if isMember(val) { return leafMember(key) }
 	if len(key) > 0 {
-		Cumulative[kLeafKV]++
+		tally(kLeafKV)
 		l := new(leafKV)
-		l.key_ = str(key); l.val_ = val
+		l.key_ = key; l.val_ = val
 		return l
 	}
-	Cumulative[kLeafV]++
+	tally(kLeafV)
 	l := new(leafV)
 	l.val_ = val
 	return l
 }
-func (l *leafV) modify(incr, i int, sub itrie) itrie {
+func leafMember(key string) itrie {
+	if len(key) > 0 {
+		tally(kLeafKM)
+		l := new(leafKM)
+		l.key_ = key
+		return l
+	}
+	tally(kLeafM)
+	return new(leafM)
+}
+func (l *leaf_) modify(incr, i int, sub itrie) itrie {
 	panic("can't modify a leaf in this way")
 }
 func (l *leafV) cloneWithKey(key string) itrie {
 	return leaf(key, l.val_)
 }
-func (l *leafV) cloneWithKeyValue(key string, val Value) (itrie, int) {
-	return leaf(key, val), 0
+func (l *leafM) cloneWithKey(key string) itrie {
+	return leafMember(str(key))
+}
+func (l *leaf_) cloneWithKeyValue(key string, val Value) (itrie, int) {
+	return leafOwning(key, val), 0
 }
-func (l *leafV) withoutValue() (itrie, int) {
+func (l *leaf_) withoutValue() (itrie, int) {
 	return nil, 1
 }
-func (l *leafV) subAt(cb byte) itrie { return nil }
+func (l *leaf_) subAt(cb byte) itrie { return nil }
+func (l *leaf_) setSub(incr, dsum int, cb byte, r itrie) {
+	panic("leaves have no sub-tries to set.")
+}
+func (l *leaf_) editor() *editor { return nil }
+func (l *leaf_) setEditor(ed *editor) {}
 func (l *leafV) with(incr int, cb byte, r itrie) itrie {
 	return bag1("", l.val_, true, cb, r)
 }
 func (l *leafKV) with(incr int, cb byte, r itrie) itrie {
 	return bag1(l.key_, l.val_, true, cb, r)
 }
-func (l *leafV) without(cb byte, r itrie) itrie {
+func (l *leafM) with(incr int, cb byte, r itrie) itrie {
+	return bag1("", member, true, cb, r)
+}
+func (l *leafKM) with(incr int, cb byte, r itrie) itrie {
+	return bag1(l.key_, member, true, cb, r)
+}
+func (l *leaf_) without(cb byte, r itrie) itrie {
 	panic("leaves can't do 'without'.")
 }
 func (l *leafV) foreach(prefix string, f func(string, Value)) {
@@ -53,10 +93,20 @@ func (l *leafV) foreach(prefix string, f func(string, Value)) {
 func (l *leafKV) foreach(prefix string, f func(string, Value)) {
 	f(prefix + l.key_, l.val_)
 }
-func (l *leafV) withsubs(start uint, end uint, fn func(byte, itrie)) {}
-func (l *leafV) key() string { return "" }
+func (l *leafM) foreach(prefix string, f func(string, Value)) {
+	f(prefix, member)
+}
+func (l *leafKM) foreach(prefix string, f func(string, Value)) {
+	f(prefix + l.key_, member)
+}
+func (l *leaf_) withsubs(start uint, end uint, fn func(byte, itrie)) {}
+func (l *leaf_) nextSub(cb uint) (byte, itrie) { return 0, nil }
+func (l *leaf_) prevSub(cb uint) (byte, itrie) { return 0, nil }
 func (l *leafKV) key() string { return l.key_ }
-func (l *leafV) count() int { return 1 }
-func (l *leafV) occupied() int { return 0 }
-func (l *leafV) expanse() expanse_t { return expanse0() }
-func (l *leafV) expanseWithout(byte) expanse_t { return expanse0() }
+func (l *leafKM) key() string { return l.key_ }
+func (l *leaf_) count() int { return 1 }
+func (l *leafV) sum() int { return weight(l.val_) }
+func (l *leafM) sum() int { return 0 }
+func (l *leaf_) occupied() int { return 0 }
+func (l *leaf_) expanse() expanse_t { return expanse0() }
+func (l *leaf_) expanseWithout(byte) expanse_t { return expanse0() }
@@ -0,0 +1,70 @@
+package immutable
+
+/*
+ MultiDict
+
+ A MultiDict holds any number of values against each key.  The values may be of any type a
+ HashDict takes as a key, such as record IDs, and each key's values are the keys of a HashDict,
+ held in a Dict, so adding a value to a key with many values copies only a path through that
+ key's HashDict rather than all of its values.  The number of pairs is kept in the MultiDict
+ itself.
+*/
+type MultiDict struct {
+	d Dict
+	total int
+}
+
+func (m MultiDict) valuesAt(key string) HashDict {
+	if v, ok := m.d.ValueAt(key); ok { return v.(HashDict) }
+	return HashDict{}
+}
+// Adds the pair (key, val), if it isn't there already.
+func (m MultiDict) Put(key string, val Value) MultiDict {
+	added := 0
+	d := m.d.Update(key, func(old Value, present bool) (Value, bool) {
+		var s HashDict
+		if present { s = old.(HashDict) }
+		r := s.Assoc(val, nil)
+		if r.t == s.t { return old, present }
+		added = 1
+		return r, true
+	})
+	return MultiDict{d, m.total + added}
+}
+// Removes the pair (key, val), and key itself if that was its last value.
+func (m MultiDict) Remove(key string, val Value) MultiDict {
+	removed := 0
+	d := m.d.Update(key, func(old Value, present bool) (Value, bool) {
+		if !present { return nil, false }
+		s := old.(HashDict)
+		r := s.Without(val)
+		if r.t == s.t { return old, true }
+		removed = 1
+		return r, r.t != nil
+	})
+	return MultiDict{d, m.total - removed}
+}
+// Removes key with all of its values.
+func (m MultiDict) RemoveAll(key string) MultiDict {
+	d, old, removed := m.d.WithoutReport(key)
+	if !removed { return m }
+	return MultiDict{d, m.total - old.(HashDict).Count()}
+}
+func (m MultiDict) Contains(key string, val Value) bool { return m.valuesAt(key).Contains(val) }
+func (m MultiDict) ContainsKey(key string) bool { return m.d.Contains(key) }
+// Calls fn for each of key's values, in no particular order.
+func (m MultiDict) Values(key string, fn func(val Value)) {
+	m.valuesAt(key).Foreach(func(val, _ Value) { fn(val) })
+}
+// The number of values key has.
+func (m MultiDict) CountValues(key string) int { return m.valuesAt(key).Count() }
+// The number of (key, value) pairs.
+func (m MultiDict) Count() int { return m.total }
+// The number of keys with at least one value.
+func (m MultiDict) CountKeys() int { return m.d.Count() }
+// Calls fn for each pair, in key order, with the values of each key in no particular order.
+func (m MultiDict) Foreach(fn func(key string, val Value)) {
+	m.d.Foreach(func(key string, vals Value) {
+		vals.(HashDict).Foreach(func(val, _ Value) { fn(key, val) })
+	})
+}
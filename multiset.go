@@ -0,0 +1,118 @@
+package immutable
+
+import "container/heap"
+
+/*
+ MultiSet
+
+ A MultiSet holds a positive count against each of its keys, in a Dict whose values are the
+ counts.  Every node of a trie keeps the sum of the counts beneath it next to the number of
+ entries beneath it, and updates both together, so Total is O(1) for any MultiSet, including
+ the ones WithPrefix and Slice return, and TotalPrefix only has to find the prefix.
+*/
+type MultiSet struct {
+	d Dict
+}
+
+// Adds n to the count of key.  n must be positive.
+func (m MultiSet) Add(key string, n int) MultiSet {
+	if n <= 0 { return m }
+	return MultiSet{m.d.Update(key, func(old Value, present bool) (Value, bool) {
+		if present { return old.(multiplicity) + multiplicity(n), true }
+		return multiplicity(n), true
+	})}
+}
+// Takes n from the count of key, removing key if that leaves nothing.  n must be positive.
+func (m MultiSet) Remove(key string, n int) MultiSet {
+	if n <= 0 { return m }
+	return MultiSet{m.d.Update(key, func(old Value, present bool) (Value, bool) {
+		if !present || int(old.(multiplicity)) <= n { return nil, false }
+		return old.(multiplicity) - multiplicity(n), true
+	})}
+}
+func (m MultiSet) Count(key string) int {
+	if v, ok := m.d.ValueAt(key); ok { return int(v.(multiplicity)) }
+	return 0
+}
+// The sum of the counts of all the keys.
+func (m MultiSet) Total() int { return sumOf(m.d.t) }
+// The sum of the counts of the keys that start with prefix.
+func (m MultiSet) TotalPrefix(prefix string) int {
+	t, _ := subtrieAt(m.d.t, prefix)
+	return sumOf(t)
+}
+// The number of keys with a count.
+func (m MultiSet) Distinct() int { return m.d.Count() }
+// Calls fn for each key and its count, in key order.
+func (m MultiSet) Foreach(fn func(key string, count int)) {
+	m.d.Foreach(func(key string, val Value) { fn(key, int(val.(multiplicity))) })
+}
+// The MultiSet holding just the keys of m that start with prefix, with their counts.
+func (m MultiSet) WithPrefix(prefix string) MultiSet { return MultiSet{m.d.WithPrefix(prefix)} }
+// The MultiSet holding just the keys of m that lie in [lo, hi), as for Dict's Slice.
+func (m MultiSet) Slice(lo, hi string) MultiSet { return MultiSet{m.d.Slice(lo, hi)} }
+
+// Returns the MultiSet in which each key's count is its count in m plus its count in other.
+func (m MultiSet) Sum(other MultiSet) MultiSet {
+	add := func(key string, a, b Value) Value { return a.(multiplicity) + b.(multiplicity) }
+	return MultiSet{m.d.Merge(other.d, add)}
+}
+/*
+ Returns the MultiSet in which each key's count is its count in m less its count in other,
+ leaving out the keys that come to nothing.
+*/
+func (m MultiSet) Difference(other MultiSet) MultiSet {
+	tr := m.d.Transient()
+	m.d.Intersect(other.d).Foreach(func(key string, val Value) {
+		c, o := val.(multiplicity), multiplicity(other.Count(key))
+		if o >= c {
+			tr.Without(key)
+		} else {
+			tr.Assoc(key, c - o)
+		}
+	})
+	return MultiSet{tr.Persistent()}
+}
+
+type counted struct {
+	key string
+	n int
+}
+// Whether a ranks below b: it has the lower count, or the same count and the later key.
+func (a counted) below(b counted) bool {
+	return a.n < b.n || (a.n == b.n && a.key > b.key)
+}
+// The keys ranked so far, lowest first.
+type ranking []counted
+
+func (r ranking) Len() int { return len(r) }
+func (r ranking) Less(i, j int) bool { return r[i].below(r[j]) }
+func (r ranking) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r *ranking) Push(x interface{}) { *r = append(*r, x.(counted)) }
+func (r *ranking) Pop() interface{} {
+	old := *r
+	x := old[len(old)-1]
+	*r = old[:len(old)-1]
+	return x
+}
+
+/*
+ Calls fn for the n keys with the highest counts, highest first.  Keys with the same count
+ come in key order.
+*/
+func (m MultiSet) Top(n int, fn func(key string, count int)) {
+	if n <= 0 { return }
+	r := make(ranking, 0, n)
+	m.d.Foreach(func(key string, val Value) {
+		c := counted{key, int(val.(multiplicity))}
+		if len(r) < n {
+			heap.Push(&r, c)
+		} else if r[0].below(c) {
+			heap.Pop(&r)
+			heap.Push(&r, c)
+		}
+	})
+	top := make([]counted, len(r))
+	for i := len(top)-1; i >= 0; i-- { top[i] = heap.Pop(&r).(counted) }
+	for _, c := range top { fn(c.key, c.n) }
+}
@@ -0,0 +1,176 @@
+package immutable
+
+// The first entry beneath t, whose own key is preceded by prefix.
+func leftmostEntry(t itrie, prefix string) (string, Value) {
+	for !t.hasVal() {
+		cb, sub := t.nextSub(0)
+		prefix += t.key() + cbstr[cb]
+		t = sub
+	}
+	return prefix + t.key(), t.val()
+}
+// The last entry beneath t, whose own key is preceded by prefix.
+func rightmostEntry(t itrie, prefix string) (string, Value) {
+	cb, sub := t.prevSub(256)
+	for sub != nil {
+		prefix += t.key() + cbstr[cb]
+		t = sub
+		cb, sub = t.prevSub(256)
+	}
+	return prefix + t.key(), t.val()
+}
+
+/*
+ Finds the first entry after key, or at key if inclusive.  On the way down, it remembers the
+ nearest sub-trie seen that lies wholly after key: if key itself isn't found, the answer is
+ the first entry of that sub-trie.  fb is that sub-trie, and the key preceding it is the
+ first fbEnd bytes of key, followed by fbCb if fbHasCb.
+*/
+func successor(t itrie, key string, inclusive bool) (string, Value, bool) {
+	var fb itrie
+	var fbEnd int
+	var fbCb byte
+	var fbHasCb bool
+	consumed := 0
+	for t != nil {
+		key_ := t.key()
+		rest := key[consumed:]
+		crit, match := findcb(rest, key_)
+		if match {
+			if inclusive && t.hasVal() { return key, t.val(), true }
+			// Everything beneath t sorts after key.
+			if cb, sub := t.nextSub(0); sub != nil {
+				fb, fbEnd, fbCb, fbHasCb = sub, len(key), cb, true
+			}
+			break
+		}
+		if crit < len(key_) {
+			if crit == len(rest) || rest[crit] < key_[crit] {
+				fb, fbEnd, fbHasCb = t, consumed, false
+			}
+			break
+		}
+		cb := rest[crit]
+		if next, sub := t.nextSub(uint(cb)+1); sub != nil {
+			fb, fbEnd, fbCb, fbHasCb = sub, consumed+crit, next, true
+		}
+		t = t.subAt(cb)
+		consumed += crit+1
+	}
+	if fb == nil { return "", nil, false }
+	prefix := key[:fbEnd]
+	if fbHasCb { prefix += cbstr[fbCb] }
+	k, v := leftmostEntry(fb, prefix)
+	return k, v, true
+}
+
+/*
+ Finds the last entry before key, or at key if inclusive.  The nearest candidate remembered
+ on the way down is either the last entry of an earlier sibling sub-trie (fb), or failing
+ that, the value of a node whose key is a prefix of key (fbVal).
+*/
+func predecessor(t itrie, key string, inclusive bool) (string, Value, bool) {
+	var fb itrie
+	var fbEnd int
+	var fbCb byte
+	var fbHasCb, fbVal bool
+	consumed := 0
+	for t != nil {
+		key_ := t.key()
+		rest := key[consumed:]
+		crit, match := findcb(rest, key_)
+		if match {
+			if inclusive && t.hasVal() { return key, t.val(), true }
+			break
+		}
+		if crit < len(key_) {
+			if crit < len(rest) && rest[crit] > key_[crit] {
+				fb, fbEnd, fbHasCb, fbVal = t, consumed, false, false
+			}
+			break
+		}
+		cb := rest[crit]
+		if prev, sub := t.prevSub(uint(cb)); sub != nil {
+			fb, fbEnd, fbCb, fbHasCb, fbVal = sub, consumed+crit, prev, true, false
+		} else if t.hasVal() {
+			fb, fbEnd, fbVal = t, consumed+crit, true
+		}
+		t = t.subAt(cb)
+		consumed += crit+1
+	}
+	if fb == nil { return "", nil, false }
+	if fbVal { return key[:fbEnd], fb.val(), true }
+	prefix := key[:fbEnd]
+	if fbHasCb { prefix += cbstr[fbCb] }
+	k, v := rightmostEntry(fb, prefix)
+	return k, v, true
+}
+
+// The entry with the greatest key <= key.
+func (d Dict) Floor(key string) (string, Value, bool) { return predecessor(d.t, key, true) }
+// The entry with the least key >= key.
+func (d Dict) Ceiling(key string) (string, Value, bool) { return successor(d.t, key, true) }
+// The entry with the greatest key < key.
+func (d Dict) Lower(key string) (string, Value, bool) { return predecessor(d.t, key, false) }
+// The entry with the least key > key.
+func (d Dict) Higher(key string) (string, Value, bool) { return successor(d.t, key, false) }
+
+// The number of entries beneath t whose keys sort before key.
+func rank(t itrie, key string) int {
+	r := 0
+	add := func(cb byte, sub itrie) { r += sub.count() }
+	for t != nil {
+		key_ := t.key()
+		crit, match := findcb(key, key_)
+		if match || crit == len(key) { break }
+		if crit < len(key_) {
+			if key[crit] > key_[crit] { r += t.count() }
+			break
+		}
+		if t.hasVal() { r++ }
+		cb := key[crit]
+		t.withsubs(0, uint(cb), add)
+		t = t.subAt(cb)
+		key = key[crit+1:]
+	}
+	return r
+}
+// The i'th entry beneath t in key order, where 0 <= i < t.count().
+func nth(t itrie, i int) (string, Value) {
+	prefix := ""
+	for !t.hasVal() || i > 0 {
+		if t.hasVal() { i-- }
+		cb, sub := t.nextSub(0)
+		for i >= sub.count() {
+			i -= sub.count()
+			cb, sub = t.nextSub(uint(cb)+1)
+		}
+		prefix += t.key() + cbstr[cb]
+		t = sub
+	}
+	return prefix + t.key(), t.val()
+}
+
+// The number of entries whose keys sort before key, which is key's index if it is present.
+func (d Dict) Rank(key string) int { return rank(d.t, key) }
+// The i'th entry in key order, and whether there is one.
+func (d Dict) Nth(i int) (string, Value, bool) {
+	if i < 0 || i >= d.Count() { return "", nil, false }
+	k, v := nth(d.t, i)
+	return k, v, true
+}
+// The i'th entry in key order.  Like indexing a slice, it panics if i is out of range.
+func (d Dict) Select(i int) (string, Value) {
+	if i < 0 || i >= d.Count() { panic("Select index out of range") }
+	return nth(d.t, i)
+}
+func (d Dict) Min() (string, Value, bool) {
+	if d.t == nil { return "", nil, false }
+	k, v := leftmostEntry(d.t, "")
+	return k, v, true
+}
+func (d Dict) Max() (string, Value, bool) {
+	if d.t == nil { return "", nil, false }
+	k, v := rightmostEntry(d.t, "")
+	return k, v, true
+}
@@ -0,0 +1,128 @@
+package immutable
+
+import "sync"
+
+/*
+ Parallel operations split the trie into pieces: whole sub-tries of at most some number of
+ entries, and, where a node had to be split, the node's own value on its own.  The pieces are
+ in key order, and are dealt out in runs of roughly equal count, one run to each worker.  How
+ the work is split depends only on the trie and the number of workers, so the results do too.
+*/
+type piece struct {
+	t itrie
+	prefix string	// the key preceding t's own key
+	only bool	// just t's own value, and not its sub-tries
+	r itrie		// the result, for ParallelMapValues
+	v Value
+}
+
+func (p *piece) count() int {
+	if p.only { return 1 }
+	return p.t.count()
+}
+// Whether t is split into smaller pieces, rather than being a piece itself.
+func split(t itrie, limit int) bool { return t.count() > limit && t.occupied() > 0 }
+func pieces(t itrie, prefix string, limit int, out []piece) []piece {
+	if !split(t, limit) { return append(out, piece{t: t, prefix: prefix}) }
+	if t.hasVal() { out = append(out, piece{t: t, prefix: prefix, only: true}) }
+	prefix += t.key()
+	t.withsubs(0, 256, func(cb byte, sub itrie) { out = pieces(sub, prefix + cbstr[cb], limit, out) })
+	return out
+}
+// The most entries a piece may have, which leaves a few pieces for each worker.
+func pieceLimit(t itrie, workers int) int {
+	limit := t.count() / (4*workers)
+	if limit < 1 { return 1 }
+	return limit
+}
+/*
+ Splits t into pieces, and calls work on each run of them in its own goroutine, numbering the
+ runs from 0.  Returns the pieces and the number of runs, which is at most workers.
+*/
+func inParallel(t itrie, workers, limit int, work func(run []piece, i int)) ([]piece, int) {
+	total := t.count()
+	ps := pieces(t, "", limit, nil)
+
+	var wg sync.WaitGroup
+	runs, start, sum := 0, 0, 0
+	for i := range ps {
+		sum += ps[i].count()
+		if i == len(ps)-1 || sum >= (runs+1)*total/workers {
+			wg.Add(1)
+			go func(run []piece, i int) {
+				work(run, i)
+				wg.Done()
+			}(ps[start:i+1], runs)
+			runs++
+			start = i+1
+		}
+	}
+	wg.Wait()
+	return ps, runs
+}
+
+/*
+ Folds the entries of d with up to workers goroutines.  Each folds a run of entries in key
+ order, starting from zero, and the results of the runs are then combined in key order.  So
+ that the answer doesn't depend on how the entries are split, zero should be an identity for
+ combine, and fold and combine should agree with each other.
+*/
+func (d Dict) ParallelFold(workers int, zero Value, fold func(acc Value, key string, val Value) Value,
+	combine func(a, b Value) Value) Value {
+	if d.t == nil { return zero }
+	if workers < 1 { workers = 1 }
+	results := make([]Value, workers)
+	_, runs := inParallel(d.t, workers, pieceLimit(d.t, workers), func(run []piece, i int) {
+		acc := zero
+		f := func(key string, val Value) { acc = fold(acc, key, val) }
+		for _, p := range run {
+			if p.only {
+				f(p.prefix + p.t.key(), p.t.val())
+			} else {
+				p.t.foreach(p.prefix, f)
+			}
+		}
+		results[i] = acc
+	})
+	r := results[0]
+	for i := 1; i < runs; i++ { r = combine(r, results[i]) }
+	return r
+}
+
+/*
+ Like MapValues, but calls fn from up to workers goroutines at once, so fn must be safe for
+ concurrent use.
+*/
+func (d Dict) ParallelMapValues(workers int, fn func(key string, val Value) Value) Dict {
+	if d.t == nil { return d }
+	if workers < 1 { workers = 1 }
+	limit := pieceLimit(d.t, workers)
+	ps, _ := inParallel(d.t, workers, limit, func(run []piece, i int) {
+		for j := range run {
+			p := &run[j]
+			if p.only {
+				p.v = fn(p.prefix + p.t.key(), p.t.val())
+			} else {
+				p.r = mapValues(p.t, p.prefix, fn)
+			}
+		}
+	})
+	// Reassemble the nodes that were split, following the pieces in the order they were made.
+	var build func(t itrie) itrie
+	build = func(t itrie) itrie {
+		if !split(t, limit) {
+			r := ps[0].r
+			ps = ps[1:]
+			return r
+		}
+		var val Value
+		if t.hasVal() {
+			val = ps[0].v
+			ps = ps[1:]
+		}
+		_, subs := subsOf(t)
+		for i, sub := range subs { subs[i] = build(sub) }
+		return cloneShape(t, val, subs)
+	}
+	return Dict{build(d.t)}
+}
@@ -0,0 +1,140 @@
+package immutable
+
+/*
+ Finds the sub-trie holding exactly the keys that start with prefix.  Returns the sub-trie and
+ the part of the key that precedes that sub-trie's own key, or nil if no key has the prefix.
+*/
+func subtrieAt(t itrie, prefix string) (itrie, string) {
+	consumed := 0
+	for t != nil {
+		key := prefix[consumed:]
+		crit, _ := findcb(key, t.key())
+		if crit == len(key) { return t, prefix[:consumed] }
+		if crit < len(t.key()) { return nil, "" }
+		t = t.subAt(key[crit])
+		consumed += crit+1
+	}
+	return nil, ""
+}
+
+/*
+ Returns the Dict holding just the entries of d whose keys start with prefix.  The keys are
+ unchanged, and the result shares everything below its root node with d.
+*/
+func (d Dict) WithPrefix(prefix string) Dict {
+	t, path := subtrieAt(d.t, prefix)
+	if t == nil { return Dict{} }
+	if len(path) == 0 { return Dict{t} }
+	return Dict{t.cloneWithKey(path + t.key())}
+}
+func (d Dict) CountPrefix(prefix string) int {
+	t, _ := subtrieAt(d.t, prefix)
+	if t == nil { return 0 }
+	return t.count()
+}
+
+/*
+ Calls fn for each entry whose key is a prefix of s (including s itself), shortest first.
+ The keys passed to fn are slices of s.
+*/
+func (d Dict) PrefixesOf(s string, fn func(string, Value)) {
+	t := d.t
+	consumed := 0
+	for t != nil {
+		crit, _ := findcb(s[consumed:], t.key())
+		if crit < len(t.key()) { return }
+		end := consumed + crit
+		if t.hasVal() { fn(s[:end], t.val()) }
+		if end == len(s) { return }
+		t = t.subAt(s[end])
+		consumed = end+1
+	}
+}
+// The entry with the longest key that is a prefix of s (including s itself).
+func (d Dict) LongestPrefixOf(s string) (key string, val Value, ok bool) {
+	t := d.t
+	consumed := 0
+	for t != nil {
+		crit, _ := findcb(s[consumed:], t.key())
+		if crit < len(t.key()) { break }
+		end := consumed + crit
+		if t.hasVal() { key, val, ok = s[:end], t.val(), true }
+		if end == len(s) { break }
+		t = t.subAt(s[end])
+		consumed = end+1
+	}
+	return
+}
+
+/*
+ Rebuilds the path on s over r, which takes the place of the sub-trie at the bottom of the path
+ (r or that sub-trie may be nil).  Unlike rebuildWith and rebuildWithout, r may hold any
+ number of entries more or fewer than what it replaces.
+*/
+func (s trieStack) rebuildOver(r itrie) itrie {
+	for i := len(s.more) - 1; i >= 0; i-- { r = rebuildOneOver(s.more[i].t, s.more[i].cb, r) }
+	for i := s.pos - 1; i >= 0; i-- { r = rebuildOneOver(s.t[i], s.cb[i], r) }
+	return r
+}
+func rebuildOneOver(t itrie, cb byte, r itrie) itrie {
+	if old := t.subAt(cb); old != nil && r != nil { return t.with(r.count() - old.count(), cb, r) }
+	return replaceSub(t, t.key(), cb, r)
+}
+
+// Returns d without the keys that start with prefix, rebuilding only the path to them.
+func (d Dict) WithoutPrefix(prefix string) Dict {
+	var s trieStack
+	t, key := d.t, prefix
+	for t != nil {
+		crit, _ := findcb(key, t.key())
+		if crit == len(key) { return Dict{s.rebuildOver(nil)} }
+		if crit < len(t.key()) { break }
+		if s.pos < segSize {
+			s.t[s.pos], s.cb[s.pos] = t, key[crit]; s.pos++
+		} else {
+			s.more = append(s.more, trieFrame{t, key[crit]})
+		}
+		t = t.subAt(key[crit])
+		key = key[crit+1:]
+	}
+	return d
+}
+/*
+ Returns d with the keys that start with prefix replaced by the entries of sub, each with
+ prefix prepended to its key.  sub's trie is mounted whole, under a copy of its root node
+ that carries the rest of the key; only the path down to it is rebuilt.
+*/
+func (d Dict) Graft(prefix string, sub Dict) Dict {
+	if sub.t == nil { return d.WithoutPrefix(prefix) }
+	var s trieStack
+	t, key := d.t, prefix
+	for t != nil {
+		key_ := t.key()
+		crit, _ := findcb(key, key_)
+		// Everything beneath t has the prefix, and is replaced.
+		if crit == len(key) { break }
+		if crit < len(key_) {
+			r := bag2(key[:crit], nil, false, key[crit], key_[crit],
+				sub.t.cloneWithKey(key[crit+1:] + sub.t.key()), t.cloneWithKey(key_[crit+1:]))
+			return Dict{s.rebuildOver(r)}
+		}
+		if s.pos < segSize {
+			s.t[s.pos], s.cb[s.pos] = t, key[crit]; s.pos++
+		} else {
+			s.more = append(s.more, trieFrame{t, key[crit]})
+		}
+		t = t.subAt(key[crit])
+		key = key[crit+1:]
+	}
+	return Dict{s.rebuildOver(rekey(sub.t, key + sub.t.key()))}
+}
+/*
+ Moves the keys that start with from so that they start with to instead, replacing any keys
+ that already start with to.  Returns d itself if no key starts with from.
+*/
+func (d Dict) RenamePrefix(from, to string) Dict {
+	t, path := subtrieAt(d.t, from)
+	if t == nil || from == to { return d }
+	moved := Dict{rekey(t, (path + t.key())[len(from):])}
+	return d.WithoutPrefix(from).Graft(to, moved)
+}
@@ -0,0 +1,92 @@
+package immutable
+
+/*
+ Works out which part of t lies in a key range.  lo and hi are the bounds relative to the
+ start of t's key, and loOn and hiOn say whether they still constrain anything beneath t.
+
+ Returns whether any of t lies in range at all and whether t's own value does.  The critical
+ bytes of the sub-tries that can hold keys in range are [start, end); of those, only loCb may
+ still be bounded by the returned lo, and only hiCb by the returned hi.
+*/
+func bounds(t itrie, lo string, loOn bool, hi string, hiOn bool) (ok, withVal bool, start, end uint, loCb, hiCb int, lo_, hi_ string) {
+	key := t.key()
+	withVal = t.hasVal()
+	start, end, loCb, hiCb = 0, 256, -1, -1
+	if loOn {
+		crit, match := findcb(lo, key)
+		switch {
+		case match || crit == len(lo):
+			// everything beneath t is >= lo
+		case crit == len(key):
+			withVal = false
+			start = uint(lo[crit]); loCb = int(lo[crit]); lo_ = lo[crit+1:]
+		case lo[crit] > key[crit]:
+			return
+		}
+	}
+	if hiOn {
+		crit, match := findcb(hi, key)
+		switch {
+		case match || crit == len(hi):
+			return
+		case crit == len(key):
+			end = uint(hi[crit])+1; hiCb = int(hi[crit]); hi_ = hi[crit+1:]
+		case key[crit] > hi[crit]:
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+func foreachRange(t itrie, prefix, lo string, loOn bool, hi string, hiOn bool, f func(string, Value)) {
+	if !loOn && !hiOn {
+		t.foreach(prefix, f)
+		return
+	}
+	ok, withVal, start, end, loCb, hiCb, lo, hi := bounds(t, lo, loOn, hi, hiOn)
+	if !ok { return }
+	prefix += t.key()
+	if withVal { f(prefix, t.val()) }
+	t.withsubs(start, end, func(cb byte, sub itrie) {
+		foreachRange(sub, prefix + cbstr[cb], lo, int(cb) == loCb, hi, int(cb) == hiCb, f)
+	})
+}
+
+/*
+ Returns the part of t in range, as a sub-trie that can take t's place.  Sub-tries that lie
+ entirely in range are reused as they are.
+*/
+func sliceRange(t itrie, lo string, loOn bool, hi string, hiOn bool) itrie {
+	if !loOn && !hiOn { return t }
+	ok, withVal, start, end, loCb, hiCb, lo, hi := bounds(t, lo, loOn, hi, hiOn)
+	if !ok { return nil }
+	var cbs []byte
+	var subs []itrie
+	t.withsubs(start, end, func(cb byte, sub itrie) {
+		if r := sliceRange(sub, lo, int(cb) == loCb, hi, int(cb) == hiCb); r != nil {
+			cbs = append(cbs, cb); subs = append(subs, r)
+		}
+	})
+	return makeNode(t.key(), t.val(), withVal, cbs, subs)
+}
+
+/*
+ Calls fn, in key order, for each entry whose key lies in [lo, hi).  Since no key sorts
+ before the empty string, an empty hi is taken to mean that there is no upper bound.
+ Sub-tries that lie entirely outside the range are never visited.
+*/
+func (d Dict) Range(lo, hi string, fn func(string, Value)) {
+	if d.t != nil {
+		foreachRange(d.t, "", lo, len(lo) > 0, hi, len(hi) > 0, fn)
+	}
+}
+/*
+ Returns the Dict holding the entries of d whose keys lie in [lo, hi), with an empty hi
+ meaning no upper bound as for Range.  Every sub-trie of d that lies entirely in the range
+ is shared with the result.
+*/
+func (d Dict) Slice(lo, hi string) Dict {
+	if d.t == nil { return d }
+	return Dict{sliceRange(d.t, lo, len(lo) > 0, hi, len(hi) > 0)}
+}
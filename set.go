@@ -0,0 +1,57 @@
+package immutable
+
+/*
+ Set
+
+ A Set is an ordered set of strings, held in the same trie as a Dict.  Its nodes are the
+ member variants, which keep a key but no value, so a Set takes less room than a Dict of the
+ same keys.  The set algebra recurses over both tries at once, and a sub-trie that both sets
+ share is taken or dropped whole, without being looked into.
+*/
+type Set struct {
+	t itrie
+}
+
+func (s Set) Add(key string) Set {
+	t, _ := assoc(s.t, key, member, nil, false)
+	return Set{t}
+}
+func (s Set) Remove(key string) Set {
+	t, _ := without(s.t, key, nil)
+	return Set{t}
+}
+func (s Set) Contains(key string) bool { return entryAt(s.t, key) != nil }
+func (s Set) Count() int {
+	if s.t != nil { return s.t.count() }
+	return 0
+}
+// Calls fn for each key in s, in order.
+func (s Set) Foreach(fn func(string)) {
+	if s.t != nil {
+		s.t.foreach("", func(key string, val Value) { fn(key) })
+	}
+}
+
+// Returns the Set of keys that are in s or in other.
+func (s Set) Union(other Set) Set {
+	if s.t == nil { return other }
+	if other.t == nil { return s }
+	keep := func(key string, a, b Value) Value { return a }
+	return Set{merge(s.t, s.t.key(), other.t, other.t.key(), "", keep)}
+}
+// Returns the Set of keys that are in both s and other.
+func (s Set) Intersect(other Set) Set {
+	if s.t == nil || other.t == nil { return Set{} }
+	return Set{intersect(s.t, s.t.key(), other.t, other.t.key())}
+}
+// Returns the Set of keys that are in s but not in other.
+func (s Set) Difference(other Set) Set {
+	if s.t == nil || other.t == nil { return s }
+	return Set{difference(s.t, s.t.key(), other.t, other.t.key())}
+}
+// Whether every key in s is also in other.
+func (s Set) IsSubset(other Set) bool {
+	if s.t == nil { return true }
+	if other.t == nil { return false }
+	return subset(s.t, s.t.key(), other.t, other.t.key())
+}
@@ -0,0 +1,104 @@
+package immutable
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+ A node under construction by FromSorted.  Its key runs from start to end in the keys being
+ loaded, and its finished sub-tries are collected in cbs and subs.  The frames are kept
+ between uses, so their slices are reused.
+*/
+type sortedFrame struct {
+	start, end int
+	val Value
+	full bool
+	cbs []byte
+	subs []itrie
+}
+
+type sortedBuilder struct {
+	frames []sortedFrame
+}
+
+func (b *sortedBuilder) push(start, end int) *sortedFrame {
+	n := len(b.frames)
+	if n < cap(b.frames) {
+		b.frames = b.frames[:n+1]
+	} else {
+		b.frames = append(b.frames, sortedFrame{})
+	}
+	f := &b.frames[n]
+	f.start, f.end, f.val, f.full = start, end, nil, false
+	f.cbs, f.subs = f.cbs[:0], f.subs[:0]
+	return f
+}
+func (b *sortedBuilder) top() *sortedFrame { return &b.frames[len(b.frames)-1] }
+// Finishes the top frame, whose key is found in key, and returns its node.
+func (b *sortedBuilder) pop(key string) itrie {
+	f := b.top()
+	t := makeNode(key[f.start:f.end], f.val, f.full, f.cbs, f.subs)
+	for i := range f.subs { f.subs[i] = nil }
+	f.val = nil
+	b.frames = b.frames[:len(b.frames)-1]
+	return t
+}
+func (f *sortedFrame) add(cb byte, t itrie) {
+	f.cbs = append(f.cbs, cb); f.subs = append(f.subs, t)
+}
+
+/*
+ Closes every frame that ends beyond crit, the length of the prefix the previous key has in
+ common with the next one.  Where no frame ends at crit, a frame is opened there to hold the
+ last closed one.
+*/
+func (b *sortedBuilder) closeTo(prev string, crit int) {
+	for len(b.frames) > 0 && b.top().end > crit {
+		parentEnd := -1
+		if len(b.frames) > 1 { parentEnd = b.frames[len(b.frames)-2].end }
+		if parentEnd < crit {
+			b.top().start = crit+1
+			t := b.pop(prev)
+			b.push(parentEnd+1, crit).add(prev[crit], t)
+			return
+		}
+		t := b.pop(prev)
+		b.top().add(prev[parentEnd], t)
+	}
+}
+
+/*
+ Builds a Dict from the entries next returns, which must be in strictly ascending key order,
+ until it returns false.  The trie is built bottom up, with each node made once at its final
+ size, so loading is much cheaper than Assoc'ing the entries one at a time.  Returns an error
+ if a key is out of order or repeated.
+*/
+func FromSorted(next func() (string, Value, bool)) (Dict, os.Error) {
+	var b sortedBuilder
+	prev := ""
+	first := true
+	for {
+		key, val, ok := next()
+		if !ok { break }
+		if !first {
+			if key <= prev {
+				if key == prev { return Dict{}, fmt.Errorf("FromSorted: duplicate key %q", key) }
+				return Dict{}, fmt.Errorf("FromSorted: key %q is out of order after %q", key, prev)
+			}
+			crit, _ := findcb(key, prev)
+			b.closeTo(prev, crit)
+		}
+		start := 0
+		if len(b.frames) > 0 { start = b.top().end+1 }
+		f := b.push(start, len(key))
+		f.val, f.full = val, true
+		prev, first = key, false
+	}
+	if first { return Dict{}, nil }
+	for len(b.frames) > 1 {
+		t := b.pop(prev)
+		b.top().add(prev[b.top().end], t)
+	}
+	return Dict{b.pop(prev)}, nil
+}
@@ -15,6 +15,8 @@ type span_ struct {
 	occupied_ uint16
 	size uint16
 	count_ int
+	sum_ int
+	editor_ *editor
 	sub [256]itrie
 }
 type spanK struct {
@@ -29,17 +31,29 @@ type spanKV struct {
 	entryKV
 	span_
 }
+type spanM struct {
+	entryM
+	span_
+}
+type spanKM struct {
+	entryKM
+	span_
+}
 
 var sizeofSpan_ uintptr
 var sizeofSpanK uintptr
 var sizeofSpanV uintptr
 var sizeofSpanKV uintptr
+var sizeofSpanM uintptr
+var sizeofSpanKM uintptr
 
 func init() {
 	var s_ span_
 	var sk spanK
 	var sv spanV
 	var skv spanKV
+	var sm spanM
+	var skm spanKM
 	var t itrie
 
 	sizeofSub = uintptr(unsafe.Sizeof(t))
@@ -47,6 +61,8 @@ func init() {
 	sizeofSpanK = uintptr(unsafe.Sizeof(sk)) - 256*sizeofSub
 	sizeofSpanV = uintptr(unsafe.Sizeof(sv)) - 256*sizeofSub
 	sizeofSpanKV = uintptr(unsafe.Sizeof(skv)) - 256*sizeofSub
+	sizeofSpanM = uintptr(unsafe.Sizeof(sm)) - 256*sizeofSub
+	sizeofSpanKM = uintptr(unsafe.Sizeof(skm)) - 256*sizeofSub
 }
 
 func newSpan_(size uint16) *span_ {
@@ -73,28 +89,49 @@ func newSpanKV(size uint16) *spanKV {
 	s.size = size
 	return s
 }
+func newSpanM(size uint16) *spanM {
+	asize := sizeofSub*uintptr(size)+sizeofSpanM
+	s := (*spanM)(unsafe.Pointer(runtime.Alloc(asize)))
+	s.size = size
+	return s
+}
+func newSpanKM(size uint16) *spanKM {
+	asize := sizeofSub*uintptr(size)+sizeofSpanKM
+	s := (*spanKM)(unsafe.Pointer(runtime.Alloc(asize)))
+	s.size = size
+	return s
+}
 func makeSpan(e expanse_t, key string, val Value, full bool) (s *span_, t itrie) {
 	size := e.size
 	emptystr := len(key) == 0
 
 	switch {
+	case !emptystr && full && isMember(val):
+		tally(kSpanKM)
+		n := newSpanKM(size)
+		n.key_ = str(key)
+		s, t = &n.span_, n
+	case emptystr && full && isMember(val):
+		tally(kSpanM)
+		n := newSpanM(size)
+		s, t = &n.span_, n
 	case !emptystr && full:
-		Cumulative[kSpanKV]++
+		tally(kSpanKV)
 		n := newSpanKV(size)
 		n.key_ = str(key); n.val_ = val
 		s, t = &n.span_, n
 	case !emptystr && !full:
-		Cumulative[kSpanK]++
+		tally(kSpanK)
 		n := newSpanK(size)
 		n.key_ = str(key)
 		s, t = &n.span_, n
 	case emptystr && full:
-		Cumulative[kSpanV]++
+		tally(kSpanV)
 		n := newSpanV(size)
 		n.val_ = val
 		s, t = &n.span_, n
 	case emptystr && !full:
-		Cumulative[kSpan_]++
+		tally(kSpan_)
 		n := newSpan_(size)
 		s, t = n, n
 	}
@@ -112,8 +149,8 @@ func span(t itrie, e expanse_t, cb byte, l itrie) itrie {
 	}
 	t.withsubs(0, uint(cb), add)
 	add(cb, l)
-	t.withsubs(uint(cb+1), 256, add)
-	s.count_ = t.count() + 1
+	t.withsubs(uint(cb)+1, 256, add)
+	s.count_ = t.count() + 1; s.sum_ = t.sum() + l.sum()
 	s.occupied_ = uint16(t.occupied() + 1)
 	return r
 }
@@ -125,73 +162,109 @@ func spanWithout(t itrie, e expanse_t, without byte) itrie {
 	s, r := makeSpan(e, t.key(), t.val(), t.hasVal())
 	add := func(cb byte, t itrie) { s.sub[cb - s.start] = t	}
 	t.withsubs(uint(e.low), uint(without), add)
-	t.withsubs(uint(without+1), uint(e.high)+1, add)
-	s.count_ = t.count() - 1
+	t.withsubs(uint(without)+1, uint(e.high)+1, add)
+	s.count_ = t.count() - 1; s.sum_ = t.sum() - t.subAt(without).sum()
 	s.occupied_ = uint16(t.occupied() - 1)
 	return r
 }
 
 func (s *span_) copy(t *span_) {
-	s.size = t.size; s.start = t.start; s.count_ = t.count_; s.occupied_ = t.occupied_
+	s.size = t.size; s.start = t.start; s.count_ = t.count_; s.sum_ = t.sum_; s.occupied_ = t.occupied_
 	copy(s.sub[:s.size], t.sub[:t.size])
 }
 func (s *span_) cloneWithKey(key string) itrie {
 	n := newSpanK(s.size)
-	Cumulative[kSpanK]++
+	tally(kSpanK)
 	n.copy(s); n.key_ = str(key)
 	return n
 }
 func (s *spanV) cloneWithKey(key string) itrie {
 	n := newSpanKV(s.size)
-	Cumulative[kSpanKV]++
+	tally(kSpanKV)
 	n.copy(&s.span_); n.key_ = str(key); n.val_ = s.val_
 	return n
 }
 func (s *spanKV) cloneWithKey(key string) itrie {
 	n := newSpanKV(s.size)
-	Cumulative[kSpanKV]++
+	tally(kSpanKV)
 	n.copy(&s.span_); n.key_ = str(key); n.val_ = s.val_
 	return n
 }
-func (s *span_) cloneWithKeyValue(key string, val Value) (itrie, int) {
+func (s *spanM) cloneWithKey(key string) itrie {
+	n := newSpanKM(s.size)
+	tally(kSpanKM)
+	n.copy(&s.span_); n.key_ = str(key)
+	return n
+}
+func (s *spanKM) cloneWithKey(key string) itrie {
+	n := newSpanKM(s.size)
+	tally(kSpanKM)
+	n.copy(&s.span_); n.key_ = str(key)
+	return n
+}
+/*
+ A copy of s, whose own value was old, holding val at key, and added more entries.  A Set's
+ member makes a spanKM, and any other value a spanKV, whatever kind s is.
+*/
+func (s *span_) cloneValued(key string, old, val Value, added int) itrie {
+	if isMember(val) {
+		n := newSpanKM(s.size)
+		tally(kSpanKM)
+		n.copy(s); n.key_ = key; n.count_ += added; n.sum_ -= weight(old)
+		return n
+	}
 	n := newSpanKV(s.size)
-	Cumulative[kSpanKV]++
-	n.copy(s); n.key_ = str(key); n.val_ = val; n.count_++
-	return n, 1
+	tally(kSpanKV)
+	n.copy(s); n.key_ = key; n.val_ = val; n.count_ += added; n.sum_ += weight(val) - weight(old)
+	return n
+}
+func (s *span_) cloneWithKeyValue(key string, val Value) (itrie, int) {
+	return s.cloneValued(key, nil, val, 1), 1
 }
 func (s *spanV) cloneWithKeyValue(key string, val Value) (itrie, int) {
-	n := newSpanKV(s.size)
-	Cumulative[kSpanKV]++
-	n.copy(&s.span_); n.key_ = str(key); n.val_ = val
-	return n, 0
+	return s.cloneValued(key, s.val_, val, 0), 0
 }
 func (s *spanKV) cloneWithKeyValue(key string, val Value) (itrie, int) {
-	n := newSpanKV(s.size)
-	Cumulative[kSpanKV]++
-	n.copy(&s.span_); n.key_ = str(key); n.val_ = val
-	return n, 0
+	return s.cloneValued(key, s.val_, val, 0), 0
+}
+func (s *spanM) cloneWithKeyValue(key string, val Value) (itrie, int) {
+	return s.cloneValued(key, member, val, 0), 0
+}
+func (s *spanKM) cloneWithKeyValue(key string, val Value) (itrie, int) {
+	return s.cloneValued(key, member, val, 0), 0
 }
 func (s *span_) modify(incr, i int, sub itrie) itrie {
 	n := newSpan_(s.size)
-	n.copy(s); n.count_ += incr; n.sub[i] = sub
+	n.copy(s); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (s *spanK) modify(incr, i int, sub itrie) itrie {
 	n := newSpanK(s.size)
 	n.key_ = s.key_
-	n.copy(&s.span_); n.count_ += incr; n.sub[i] = sub
+	n.copy(&s.span_); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (s *spanV) modify(incr, i int, sub itrie) itrie {
 	n := newSpanV(s.size)
 	n.val_ = s.val_
-	n.copy(&s.span_); n.count_ += incr; n.sub[i] = sub
+	n.copy(&s.span_); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (s *spanKV) modify(incr, i int, sub itrie) itrie {
 	n := newSpanKV(s.size)
 	n.key_ = s.key_; n.val_ = s.val_
-	n.copy(&s.span_); n.count_ += incr; n.sub[i] = sub
+	n.copy(&s.span_); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
+	return n
+}
+func (s *spanM) modify(incr, i int, sub itrie) itrie {
+	n := newSpanM(s.size)
+	n.copy(&s.span_); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
+	return n
+}
+func (s *spanKM) modify(incr, i int, sub itrie) itrie {
+	n := newSpanKM(s.size)
+	n.key_ = s.key_
+	n.copy(&s.span_); n.count_ += incr; n.sum_ += sub.sum() - n.sub[i].sum(); n.sub[i] = sub
 	return n
 }
 func (s *span_) withoutValue() (itrie, int) {
@@ -201,9 +274,9 @@ func (s *spanK) withoutValue() (itrie, int) {
 	return s, 0
 }
 func (s *span_) collapse(key string) (itrie, int) {
-	for i, t := range s.sub {
+	for i, t := range s.sub[:s.size] {
 		if t != nil {
-			key += string(byte(i)+s.start) + t.key()
+			key += cbstr[byte(i)+s.start] + t.key()
 			return t.cloneWithKey(key), 1
 			break 
 		}
@@ -213,10 +286,22 @@ func (s *span_) collapse(key string) (itrie, int) {
 func (s *spanV) withoutValue() (itrie, int) {
 	if s.occupied_ == 1 { return s.collapse("") }
 	n := newSpan_(s.size)
-	n.copy(&s.span_); n.count_--
+	n.copy(&s.span_); n.count_--; n.sum_ -= weight(s.val_)
 	return n, 1
 }
 func (s *spanKV) withoutValue() (itrie, int) {
+	if s.occupied_ == 1 { return s.collapse(s.key_) }
+	n := newSpanK(s.size)
+	n.copy(&s.span_); n.key_ = s.key_; n.count_--; n.sum_ -= weight(s.val_)
+	return n, 1
+}
+func (s *spanM) withoutValue() (itrie, int) {
+	if s.occupied_ == 1 { return s.collapse("") }
+	n := newSpan_(s.size)
+	n.copy(&s.span_); n.count_--
+	return n, 1
+}
+func (s *spanKM) withoutValue() (itrie, int) {
 	if s.occupied_ == 1 { return s.collapse(s.key_) }
 	n := newSpanK(s.size)
 	n.copy(&s.span_); n.key_ = s.key_; n.count_--
@@ -226,6 +311,7 @@ func (n *span_) withSpan(s *span_, incr int, e expanse_t, cb byte, r itrie) {
 	if e.low > s.start { panic("new start must be <= old start") }
 	if int(e.size) < int(s.size) { panic("new size must be >= old size") }
 	n.start = e.low; n.count_ = s.count_ + incr; n.occupied_ = s.occupied_
+	n.sum_ = s.sum_ + r.sum() - sumOf(s.subAt(cb))
 	copy(n.sub[s.start - n.start:n.size], s.sub[:s.size])
 	i := int(cb - n.start)
 	o := n.sub[i]; n.sub[i] = r
@@ -235,7 +321,7 @@ func (s *span_) with(incr int, cb byte, r itrie) itrie {
 	t, e := s.maybeGrow(s, cb, r)
 	if t != nil { return t }
 	n := newSpan_(e.size)
-	Cumulative[kSpan_]++
+	tally(kSpan_)
 	n.withSpan(s, incr, e, cb, r)
 	return n
 }
@@ -243,7 +329,7 @@ func (s *spanK) with(incr int, cb byte, r itrie) itrie {
 	t, e := s.maybeGrow(s, cb, r)
 	if t != nil { return t }
 	n := newSpanK(e.size)
-	Cumulative[kSpanK]++
+	tally(kSpanK)
 	n.key_ = s.key_
 	n.withSpan(&s.span_, incr, e, cb, r)
 	return n
@@ -252,7 +338,7 @@ func (s *spanV) with(incr int, cb byte, r itrie) itrie {
 	t, e := s.maybeGrow(s, cb, r)
 	if t != nil { return t }
 	n := newSpanV(e.size)
-	Cumulative[kSpanV]++
+	tally(kSpanV)
 	n.val_ = s.val_
 	n.withSpan(&s.span_, incr, e, cb, r)
 	return n
@@ -261,16 +347,42 @@ func (s *spanKV) with(incr int, cb byte, r itrie) itrie {
 	t, e := s.maybeGrow(s, cb, r)
 	if t != nil { return t }
 	n := newSpanKV(e.size)
-	Cumulative[kSpanKV]++
+	tally(kSpanKV)
 	n.key_ = s.key_; n.val_ = s.val_
 	n.withSpan(&s.span_, incr, e, cb, r)
 	return n
 }
+func (s *spanM) with(incr int, cb byte, r itrie) itrie {
+	t, e := s.maybeGrow(s, cb, r)
+	if t != nil { return t }
+	n := newSpanM(e.size)
+	tally(kSpanM)
+	n.withSpan(&s.span_, incr, e, cb, r)
+	return n
+}
+func (s *spanKM) with(incr int, cb byte, r itrie) itrie {
+	t, e := s.maybeGrow(s, cb, r)
+	if t != nil { return t }
+	n := newSpanKM(e.size)
+	tally(kSpanKM)
+	n.key_ = s.key_
+	n.withSpan(&s.span_, incr, e, cb, r)
+	return n
+}
 func (s *span_) subAt(cb byte) itrie {
 	i := int(cb) - int(s.start)
 	if i < 0 || i >= int(s.size) { return nil }
 	return s.sub[i]
 }
+func (s *span_) setSub(incr, dsum int, cb byte, r itrie) {
+	s.sub[cb - s.start] = r; s.count_ += incr; s.sum_ += dsum
+}
+func (s *spanV) setVal(val Value) {
+	s.sum_ += weight(val) - weight(s.val_); s.val_ = val
+}
+func (s *spanKV) setVal(val Value) {
+	s.sum_ += weight(val) - weight(s.val_); s.val_ = val
+}
 func (s *span_) maybeGrow(t itrie, cb byte, r itrie) (itrie, expanse_t) {
 	// Update expanse
 	e0 := s.expanse()
@@ -324,7 +436,7 @@ func (s *span_) without_(t itrie, cb byte, r itrie) itrie {
 		return s.shrink(t, cb)
 	}
 	i := int(cb) - int(s.start)
-	return s.modify(-1, i, r)
+	return t.modify(-1, i, r)
 }
 func (s *span_) without(cb byte, r itrie) itrie {
 	return s.without_(s, cb, r)
@@ -338,6 +450,12 @@ func (s *spanV) without(cb byte, r itrie) itrie {
 func (s *spanKV) without(cb byte, r itrie) itrie {
 	return s.without_(s, cb, r)
 }
+func (s *spanM) without(cb byte, r itrie) itrie {
+	return s.without_(s, cb, r)
+}
+func (s *spanKM) without(cb byte, r itrie) itrie {
+	return s.without_(s, cb, r)
+}
 func (s *span_) shrink(t itrie, cb byte) itrie {
 	// We removed a leaf -- shrink our children & possibly turn into a bag or leaf.
 	occupied := s.occupied_ - 1
@@ -354,7 +472,7 @@ func (s *span_) shrink(t itrie, cb byte) itrie {
 			if o != i && s.sub[o] != nil { break }
 		}
 		if o >= int(s.size) { panic("We should have another valid sub-trie") }
-		key := t.key() + string(cb) + s.sub[o].key()
+		key := t.key() + cbstr[s.start+byte(o)] + s.sub[o].key()
 		return s.sub[o].cloneWithKey(key)
 	}
 	e := s.expanse()
@@ -373,9 +491,9 @@ func (s *span_) shrink(t itrie, cb byte) itrie {
 	return bitmapWithout(t, e, cb)
 }
 func (s *span_) foreach(prefix string, f func(string, Value)) {
-	for i, t := range s.sub {
+	for i, t := range s.sub[:s.size] {
 		if t != nil {
-			t.foreach(prefix + string(s.start+byte(i)), f)
+			t.foreach(prefix + cbstr[s.start+byte(i)], f)
 		}
 	}
 }
@@ -392,6 +510,15 @@ func (s *spanKV) foreach(prefix string, f func(string, Value)) {
 	f(prefix, s.val_)
 	s.span_.foreach(prefix, f)
 }
+func (s *spanM) foreach(prefix string, f func(string, Value)) {
+	f(prefix, member)
+	s.span_.foreach(prefix, f)
+}
+func (s *spanKM) foreach(prefix string, f func(string, Value)) {
+	prefix += s.key_
+	f(prefix, member)
+	s.span_.foreach(prefix, f)
+}
 
 func (s *span_) withsubs(start, end uint, f func(byte, itrie)) {
 	start = uint(min(max(0, int(start) - int(s.start)), int(s.size)))
@@ -403,7 +530,22 @@ func (s *span_) withsubs(start, end uint, f func(byte, itrie)) {
 		f(cb, t)
 	}
 }
+func (s *span_) nextSub(cb uint) (byte, itrie) {
+	for i := max(0, int(cb) - int(s.start)); i < int(s.size); i++ {
+		if s.sub[i] != nil { return s.start + byte(i), s.sub[i] }
+	}
+	return 0, nil
+}
+func (s *span_) prevSub(cb uint) (byte, itrie) {
+	for i := min(int(cb) - int(s.start), int(s.size)) - 1; i >= 0; i-- {
+		if s.sub[i] != nil { return s.start + byte(i), s.sub[i] }
+	}
+	return 0, nil
+}
 func (s *span_) count() int { return s.count_ }
+func (s *span_) sum() int { return s.sum_ }
 func (s *span_) occupied() int { return int(s.occupied_) }
+func (s *span_) editor() *editor { return s.editor_ }
+func (s *span_) setEditor(ed *editor) { s.editor_ = ed }
 func (s *span_) expanse() expanse_t { return expanse(s.start, s.start+byte(s.size-1)) }
 
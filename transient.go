@@ -0,0 +1,55 @@
+package immutable
+
+/*
+ Transient
+
+ A Transient is an editable Dict, for building one up in a batch.  It starts out sharing all
+ of its nodes with the Dict it came from, and the first change along any path copies that
+ path as usual; but the copies are owned by the Transient, so later changes that pass
+ through them are made in place instead of copying again.  Persistent freezes the Transient
+ back into a Dict in constant time, after which the Transient can't be used any more.
+
+ A Transient is not safe for concurrent use.
+*/
+type Transient struct {
+	t itrie
+	ed *editor
+}
+
+func (d Dict) Transient() *Transient {
+	return &Transient{d.t, new(editor)}
+}
+func (tr *Transient) check() {
+	if tr.ed.done { panic("Transient used after Persistent") }
+}
+func (tr *Transient) Assoc(key string, val Value) {
+	tr.check()
+	tr.t, _ = assoc(tr.t, key, val, tr.ed, false)
+}
+func (tr *Transient) Without(key string) {
+	tr.check()
+	tr.t, _ = without(tr.t, key, tr.ed)
+}
+func (tr *Transient) Contains(key string) bool {
+	tr.check()
+	return entryAt(tr.t, key) != nil
+}
+func (tr *Transient) ValueAt(key string) (Value, bool) {
+	tr.check()
+	e := entryAt(tr.t, key)
+	if e != nil { return e.val(), true }
+	return nil, false
+}
+func (tr *Transient) Count() int {
+	tr.check()
+	if tr.t != nil { return tr.t.count() }
+	return 0
+}
+// Returns the Dict the Transient has built, and retires the Transient.
+func (tr *Transient) Persistent() Dict {
+	tr.check()
+	tr.ed.done = true
+	d := Dict{tr.t}
+	tr.t = nil
+	return d
+}
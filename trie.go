@@ -3,30 +3,46 @@ package immutable
 import (
 	"fmt"
 	"reflect"
+	"sync/atomic"
+	"unsafe"
 )
 
 const (
 	kLeafV = iota
 	kLeafKV
+	kLeafM
+	kLeafKM
 	kBag_
 	kBagK
 	kBagV
 	kBagKV
+	kBagM
+	kBagKM
 	kSpan_
 	kSpanK
 	kSpanV
 	kSpanKV
+	kSpanM
+	kSpanKM
 	kBitmap_
 	kBitmapK
 	kBitmapV
 	kBitmapKV
+	kBitmapM
+	kBitmapKM
 	
 	numVariants
 )
 
-type Stats [numVariants]int
+type Stats [numVariants]int64
 var Cumulative Stats
 
+// Counts the allocation of a node.  Dicts are updated from many goroutines at once, so the
+// cumulative counts have to be maintained atomically.
+func tally(variant int) {
+	atomic.AddInt64(&Cumulative[variant], 1)
+}
+
 func GetStats(d Dict) Stats {
 	var stats Stats
 	if d.t != nil {
@@ -35,18 +51,26 @@ func GetStats(d Dict) Stats {
 			switch n := t.(type) {
 			case *leafV: stats[kLeafV]++
 			case *leafKV: stats[kLeafKV]++
+			case *leafM: stats[kLeafM]++
+			case *leafKM: stats[kLeafKM]++
 			case *bag_: stats[kBag_]++
 			case *bagK: stats[kBagK]++
 			case *bagV: stats[kBagV]++
 			case *bagKV: stats[kBagKV]++
+			case *bagM: stats[kBagM]++
+			case *bagKM: stats[kBagKM]++
 			case *span_: stats[kSpan_]++
 			case *spanK: stats[kSpanK]++
 			case *spanV: stats[kSpanV]++
 			case *spanKV: stats[kSpanKV]++
+			case *spanM: stats[kSpanM]++
+			case *spanKM: stats[kSpanKM]++
 			case *bitmap_: stats[kBitmap_]++
 			case *bitmapK: stats[kBitmapK]++
 			case *bitmapV: stats[kBitmapV]++
 			case *bitmapKV: stats[kBitmapKV]++
+			case *bitmapM: stats[kBitmapM]++
+			case *bitmapKM: stats[kBitmapKM]++
 			}
 			t.withsubs(0, 256, collect)
 		}
@@ -56,8 +80,9 @@ func GetStats(d Dict) Stats {
 }
 
 func ResetCumulativeStats() {
+	// Take away what was there, so that counts made meanwhile aren't lost.
 	for i, _ := range Cumulative {
-		Cumulative[i] = 0
+		atomic.AddInt64(&Cumulative[i], -atomic.AddInt64(&Cumulative[i], 0))
 	}
 }
 
@@ -65,34 +90,50 @@ func PrintStats(stats Stats) {
 	statNames := [numVariants]string{
 		"leafV",
 		"leafKV",
+		"leafM",
+		"leafKM",
 		"bag_",
 		"bagK",
 		"bagV",
 		"bagKV",
+		"bagM",
+		"bagKM",
 		"span_",
 		"spanK",
 		"spanV",
 		"spanKV",
+		"spanM",
+		"spanKM",
 		"bitmap_",
 		"bitmapK",
 		"bitmapV",
 		"bitmapKV",
+		"bitmapM",
+		"bitmapKM",
 	}
 	sizes := [numVariants]uintptr{
 		reflect.Typeof(leafV{}).Size(),
 		reflect.Typeof(leafKV{}).Size(),
+		reflect.Typeof(leafM{}).Size(),
+		reflect.Typeof(leafKM{}).Size(),
 		reflect.Typeof(bag_{}).Size(),
 		reflect.Typeof(bagK{}).Size(),
 		reflect.Typeof(bagV{}).Size(),
 		reflect.Typeof(bagKV{}).Size(),
+		reflect.Typeof(bagM{}).Size(),
+		reflect.Typeof(bagKM{}).Size(),
 		reflect.Typeof(span_{}).Size(),
 		reflect.Typeof(spanK{}).Size(),
 		reflect.Typeof(spanV{}).Size(),
 		reflect.Typeof(spanKV{}).Size(),
+		reflect.Typeof(spanM{}).Size(),
+		reflect.Typeof(spanKM{}).Size(),
 		reflect.Typeof(bitmap_{}).Size(),
 		reflect.Typeof(bitmapK{}).Size(),
 		reflect.Typeof(bitmapV{}).Size(),
 		reflect.Typeof(bitmapKV{}).Size(),
+		reflect.Typeof(bitmapM{}).Size(),
+		reflect.Typeof(bitmapKM{}).Size(),
 	}
 	for i, v := range stats {
 		fmt.Printf("%s: %d (%d)\n", statNames[i], v, uintptr(v)*sizes[i])
@@ -107,6 +148,24 @@ func str(s string) string {
 	bytes := []byte(s)
 	return string(bytes)
 }
+/*
+ Returns s for a node to keep as its key.  Unless the caller has promised that s isn't part of
+ some larger string, and so can be kept as it is (adopt), that is a copy.
+*/
+func ownKey(s string, adopt bool) string {
+	if adopt { return s }
+	return str(s)
+}
+
+// The one byte string for each critical byte.  Note that string(cb) would instead give the
+// UTF-8 encoding of cb as a code point, which is two bytes long for cb >= 0x80.
+var cbstr [256]string
+
+func init() {
+	for i := range cbstr {
+		cbstr[i] = string([]byte{byte(i)})
+	}
+}
 
 func abs(x int) int {
 	if x < 0 { return -x }
@@ -123,6 +182,11 @@ func max(a, b int) int {
 	return b
 }
 
+// Whether a and b are copies of one interface value: the same type, and the same data word.
+func identical(a, b Value) bool {
+	return *(*[2]uintptr)(unsafe.Pointer(&a)) == *(*[2]uintptr)(unsafe.Pointer(&b))
+}
+
 type expanse_t struct {
 	low byte
 	high byte
@@ -172,93 +236,141 @@ func splitKey(key string, crit int) (string, byte, string) {
 }
 
 const segSize = 32
+/*
+ trieStack
+
+ Records the path taken down a trie by assoc and without, so that the changed nodes can be
+ rebuilt on the way back up.  Each operation declares its own trieStack as a local variable;
+ the first segSize entries are held inline and only deeper paths spill into the more slice.
+ Taking the address of the stack would move it to the heap on every call, so the operations
+ push onto it by indexing the arrays directly, and the rebuild methods take it by value.
+*/
 type trieStack struct {
 	t [segSize]itrie
 	cb [segSize]byte
 	pos int
-	next *trieStack
-}
-func (s *trieStack) reset() *trieStack {
-	s.next = nil
-	s.pos = 0
-	return s
-}
-func (s *trieStack) push(cb byte, t itrie) *trieStack {
-	if s.pos >= segSize {
-		fmt.Println("Growing stack")
-		s.pos--
-		next := new(trieStack)
-		next.next = s
-		s = next
-	}
-	s.t[s.pos] = t
-	s.cb[s.pos] = cb
-	s.pos++
-	return s
-}
-func (s *trieStack) pop() (itrie, byte, *trieStack, bool) {
-	s.pos--
-	if s.pos < 0 {
-		s = s.next
-	}
-	if s == nil { return nil, 0, nil, true }
-	return s.t[s.pos], s.cb[s.pos], s, false
+	more []trieFrame
 }
+type trieFrame struct {
+	t itrie
+	cb byte
+}
+
+/*
+ editor
 
-// Use a global variable to avoid putting the first stack segment on the heap
-var stack trieStack
+ Owns the nodes a Transient has made for itself.  A node whose editor is that of a live
+ Transient is reachable only through that Transient, so it may be changed in place; every
+ other node is shared, and is copied as usual.  assoc and without take the editor to build
+ with, or nil to build persistently.
 
-func assoc(t itrie, key string, val Value) (itrie, int) {
-	s := stack.reset()
+ A node a Transient owns is only ever the sub-trie of another node it owns.  A node changed in
+ place can't say what it held before, so the node above it has to be told what changed, as
+ setSub is, rather than work it out from the old node, as with and modify do.
+*/
+type editor struct {
+	done bool
+}
+func owned(t itrie, ed *editor) bool { return ed != nil && t.editor() == ed }
+
+/*
+ Returns the sub-trie that takes t's place when key is added to it with val, where t is nil or
+ its key first differs from key at crit, before its end.  Only these new nodes keep any part of
+ key itself, so only they need to know whether key may be adopted.  The copy of t is given to
+ ed, if there is one, since the sub-tries it shares with t may be ed's.
+*/
+func addKey(t itrie, key string, crit int, val Value, ed *editor, adopt bool) itrie {
+	if t == nil { return leafOwning(ownKey(key, adopt), val) }
+	prefix, cb, rest := splitKey(key, crit)
+	_, cb_, rest_ := splitKey(t.key(), crit)
+	sub := t.cloneWithKey(rest_)
+	if ed != nil { sub.setEditor(ed) }
+	if crit == len(key) {
+		b, r := makeBagOwning(1, ownKey(prefix, adopt), val, true)
+		b.init1(cb_, sub)
+		return r
+	}
+	b, r := makeBagOwning(2, ownKey(prefix, adopt), nil, false)
+	b.init2(cb, cb_, leafOwning(ownKey(rest, adopt), val), sub)
+	return r
+}
+
+func assoc(t itrie, key string, val Value, ed *editor, adopt bool) (itrie, int) {
+	var s trieStack
 	var r itrie
-	var added int
+	var added, before int	// before is the sum of the sub-trie r replaces
+	root := t
 
 	for {
 		if t == nil {
-			r, added = leaf(key, val), 1
+			r, added = addKey(nil, key, 0, val, ed, adopt), 1
 			break
 		}
 		key_ := t.key()
 		crit, match := findcb(key, key_)
 		if match {
-			r, added = t.cloneWithKeyValue(key, val)
+			// Setting a key to the value it already has changes nothing.
+			if t.hasVal() && identical(t.val(), val) { return root, 0 }
+			before = t.sum()
+			if owned(t, ed) && t.hasVal() {
+				t.setVal(val)
+				r, added = t, 0
+			} else {
+				// key_ is the same as key, and the node already owns it, so nothing is copied.
+				r, added = t.cloneWithKeyValue(key_, val)
+			}
 			break
 		}
 		
-		prefix, cb, rest := splitKey(key, crit)
-		_, cb_, rest_ := splitKey(key_, crit)
-
 		if crit < len(key_) {
-			added = 1
-			if crit == len(key) {
-				r = bag1(prefix, val, true, cb_, t.cloneWithKey(rest_))
-			} else {
-				r = bag2(prefix, nil, false, cb, cb_,
-					leaf(rest, val), t.cloneWithKey(rest_))
-			}
+			before = t.sum()
+			r, added = addKey(t, key, crit, val, ed, adopt), 1
 			break
 		}
-		s = s.push(cb, t)
+		_, cb, rest := splitKey(key, crit)
+		if s.pos < segSize {
+			s.t[s.pos], s.cb[s.pos] = t, cb; s.pos++
+		} else {
+			s.more = append(s.more, trieFrame{t, cb})
+		}
 		t = t.subAt(cb)
 		key = rest
 	}
-	// At this point, we have the bottom-most sub trie in r, and tries/cbs has the
+	// At this point, we have the bottom-most sub trie in r, and the stack has the
 	// information about the changes we need to build up the tree
-	for s != nil {		
-		t, cb, next, done := s.pop()
-		if done { break }
-		r = t.with(added, cb, r)
-		s = next
+	return s.rebuildWith(r, added, r.sum() - before, ed), added
+}
+/*
+ Rebuilds the path on the stack over r, which holds added more entries than what it replaces,
+ and whose sum is dsum more.
+*/
+func (s trieStack) rebuildWith(r itrie, added, dsum int, ed *editor) itrie {
+	if ed != nil { r.setEditor(ed) }
+	for i := len(s.more) - 1; i >= 0; i-- { r = rebuildOneWith(s.more[i].t, s.more[i].cb, r, added, dsum, ed) }
+	for i := s.pos - 1; i >= 0; i-- { r = rebuildOneWith(s.t[i], s.cb[i], r, added, dsum, ed) }
+	return r
+}
+// Rebuilds t over r, its new sub-trie at cb.
+func rebuildOneWith(t itrie, cb byte, r itrie, added, dsum int, ed *editor) itrie {
+	if owned(t, ed) && t.subAt(cb) != nil {
+		t.setSub(added, dsum, cb, r)
+		return t
 	}
-	return r, added
+	r = t.with(added, cb, r)
+	if ed != nil { r.setEditor(ed) }
+	return r
 }
 
-func without(t itrie, key string) (itrie, int) {
-	s := stack.reset()
+func without(t itrie, key string, ed *editor) (itrie, int) {
+	var s trieStack
 	r := t
-	removed := 0
+	removed, before := 0, 0
 
-	for t != nil {
+	for {
+		if t == nil {
+			// we don't have the element being removed
+			return r, 0
+		}
 		key_ := t.key()
 		crit, match := findcb(key, key_)
 		if crit < len(key_) {
@@ -270,6 +382,7 @@ func without(t itrie, key string) (itrie, int) {
 				// don't have the element being removed
 				return r, 0
 			}
+			before = t.sum()
 			r, removed = t.withoutValue()
 			break
 		}
@@ -279,27 +392,125 @@ func without(t itrie, key string) (itrie, int) {
 		}
 
 		_, cb, rest := splitKey(key, crit)
-
-		s = s.push(cb, t)
+		if s.pos < segSize {
+			s.t[s.pos], s.cb[s.pos] = t, cb; s.pos++
+		} else {
+			s.more = append(s.more, trieFrame{t, cb})
+		}
 		t = t.subAt(cb)
 		key = rest
 	}
-	// At this point, we have the bottom most sub trie (possibly nil) in r, and tries/cbs
+	// At this point, we have the bottom most sub trie (possibly nil) in r, and the stack
 	// has the information about the changes we need to build up the tree
-	for s != nil {
-		t, cb, next, done := s.pop()
-		if done { break }
-		r = t.without(cb, r)
-		s = next
+	return s.rebuildWithout(r, removed, sumOf(r) - before, ed), removed
+}
+/*
+ Rebuilds the path on the stack over r (possibly nil), which holds removed fewer entries, and
+ whose sum is dsum more.
+*/
+func (s trieStack) rebuildWithout(r itrie, removed, dsum int, ed *editor) itrie {
+	if r != nil && ed != nil { r.setEditor(ed) }
+	for i := len(s.more) - 1; i >= 0; i-- { r = rebuildOneWithout(s.more[i].t, s.more[i].cb, r, removed, dsum, ed) }
+	for i := s.pos - 1; i >= 0; i-- { r = rebuildOneWithout(s.t[i], s.cb[i], r, removed, dsum, ed) }
+	return r
+}
+// Rebuilds t over r (possibly nil), its new sub-trie at cb.
+func rebuildOneWithout(t itrie, cb byte, r itrie, removed, dsum int, ed *editor) itrie {
+	if r != nil && owned(t, ed) {
+		t.setSub(-removed, dsum, cb, r)
+		return t
 	}
-	return r, removed
+	r = t.without(cb, r)
+	if r != nil && ed != nil { r.setEditor(ed) }
+	return r
+}
+
+/*
+ Finds key, calls fn with its value and whether it is present, and makes the change fn asks
+ for in the same pass: if keep is false the key is removed, and otherwise it is set to the
+ value fn returns.  When nothing changes, t itself is returned.
+*/
+func update(t itrie, key string, fn func(Value, bool) (Value, bool)) itrie {
+	var s trieStack
+	root := t
+	crit, match := 0, false
+	for t != nil {
+		crit, match = findcb(key, t.key())
+		if match || crit < len(t.key()) { break }
+		if s.pos < segSize {
+			s.t[s.pos], s.cb[s.pos] = t, key[crit]; s.pos++
+		} else {
+			s.more = append(s.more, trieFrame{t, key[crit]})
+		}
+		t = t.subAt(key[crit])
+		key = key[crit+1:]
+	}
+	var old Value
+	present := t != nil && match && t.hasVal()
+	if present { old = t.val() }
+	val, keep := fn(old, present)
+	switch {
+	case !keep && !present:
+		return root
+	case !keep:
+		r, removed := t.withoutValue()
+		return s.rebuildWithout(r, removed, sumOf(r) - t.sum(), nil)
+	case present && identical(val, old):
+		return root
+	}
+	if t != nil && match {
+		r, added := t.cloneWithKeyValue(t.key(), val)
+		return s.rebuildWith(r, added, r.sum() - t.sum(), nil)
+	}
+	r := addKey(t, key, crit, val, nil, false)
+	return s.rebuildWith(r, 1, r.sum() - sumOf(t), nil)
+}
+
+/*
+ Constructs a node with the given key and optional value over the given sub-tries, whose
+ critical bytes must be in ascending order.  The representation is chosen by the same rules
+ assoc and without follow, and the node collapses into a leaf or into its only sub-trie when
+ it has too little to hold.
+*/
+func makeNode(key string, val Value, full bool, cbs []byte, subs []itrie) itrie {
+	n := len(cbs)
+	if n == 0 {
+		if !full { return nil }
+		return leaf(key, val)
+	}
+	if n == 1 && !full {
+		return subs[0].cloneWithKey(key + cbstr[cbs[0]] + subs[0].key())
+	}
+	count, sum := 0, 0
+	if full { count, sum = 1, weight(val) }
+	for _, sub := range subs { count += sub.count(); sum += sub.sum() }
+
+	e := expanse(cbs[0], cbs[n-1])
+	if n >= minSpanSize && spanOK(e, n) {
+		s, r := makeSpan(e, key, val, full)
+		for i, cb := range cbs { s.sub[cb - s.start] = subs[i] }
+		s.count_ = count; s.sum_ = sum; s.occupied_ = uint16(n)
+		return r
+	}
+	if n <= maxBagSize {
+		b, r := makeBag(uint8(n), key, val, full)
+		copy(b.cb[:n], cbs); copy(b.sub[:n], subs)
+		b.count_ = count; b.sum_ = sum
+		return r
+	}
+	b, r := makeBitmap(n, key, val, full)
+	for i, cb := range cbs {
+		b.sub[i] = subs[i]; b.setbit(bitpos(uint(cb)))
+	}
+	b.count_ = count; b.sum_ = sum
+	return r
 }
 
 func entryAt(t itrie, key string) itrie {
 	for t != nil {
 		crit, match := findcb(key, t.key())
 		if match && t.hasVal() { return t }
-		if crit >= len(key) { return nil }
+		if crit >= len(key) || crit < len(t.key()) { return nil }
 		_, cb, rest := splitKey(key, crit)
 		t = t.subAt(cb)
 		key = rest
@@ -320,15 +531,26 @@ type itrie interface {
 	with(incr int, cb byte, r itrie) itrie
 	modify(incr, i int, t itrie) itrie
 	cloneWithKey(string) itrie
+	// Unlike cloneWithKey, keeps the key it is given rather than a copy.
 	cloneWithKeyValue(string, Value) (itrie, int)
 	without(cb byte, r itrie) itrie
 	withoutValue() (itrie, int)
 	count() int
+	// The total weight of the values in the trie.
+	sum() int
 	occupied() int
 	expanse() expanse_t
 	expanseWithout(byte) expanse_t
 	foreach(string, func(string, Value))
 	withsubs(start uint, end uint, fn func (byte, itrie))
+	// The first sub-trie with a critical byte >= cb, and the last one with a critical byte < cb.
+	nextSub(cb uint) (byte, itrie)
+	prevSub(cb uint) (byte, itrie)
+	// In-place edits, only ever made to a node owned by the editor of a live Transient.
+	editor() *editor
+	setEditor(*editor)
+	setSub(incr, dsum int, cb byte, r itrie)
+	setVal(Value)
 }
 
 /*
@@ -344,6 +566,7 @@ type entry_ struct {}
 func (e entry_) key() string { return "" }
 func (e entry_) val() Value { return nil }
 func (e entry_) hasVal() bool { return false }
+func (e *entry_) setVal(Value) { panic("no value to set.") }
 
 type entryK struct {
 	key_ string
@@ -351,6 +574,7 @@ type entryK struct {
 func (e entryK) key() string { return e.key_ }
 func (e entryK) val() Value { return nil }
 func (e entryK) hasVal() bool { return false }
+func (e *entryK) setVal(Value) { panic("no value to set.") }
 
 type entryV struct {
 	val_ Value
@@ -358,6 +582,7 @@ type entryV struct {
 func (e entryV) key() string { return "" }
 func (e entryV) val() Value { return e.val_ }
 func (e entryV) hasVal() bool { return true }
+func (e *entryV) setVal(val Value) { e.val_ = val }
 
 type entryKV struct {
 	key_ string
@@ -366,4 +591,49 @@ type entryKV struct {
 func (e entryKV) key() string { return e.key_ }
 func (e entryKV) val() Value { return e.val_ }
 func (e entryKV) hasVal() bool { return true }
+func (e *entryKV) setVal(val Value) { e.val_ = val }
+
+/*
+ A MultiSet's values are multiplicities, the only values that weigh anything.  Each node keeps
+ the sum of the weights of its values alongside their count, so that the sum of any sub-trie is
+ at hand without visiting it.
+*/
+type multiplicity int
+func weight(val Value) int {
+	if n, ok := val.(multiplicity); ok { return int(n) }
+	return 0
+}
+func sumOf(t itrie) int {
+	if t == nil { return 0 }
+	return t.sum()
+}
+
+/*
+ A Set's nodes hold no values, only keys.  They are the M variants, which take member as their
+ value without storing it.  Whatever kind a node was, giving it member makes an M variant and
+ giving it any other value makes a V or KV variant, so the two can share sub-tries.
+*/
+type setMember struct {}
+var member Value = setMember{}
+func isMember(val Value) bool {
+	_, ok := val.(setMember)
+	return ok
+}
 
+type entryM struct {}
+func (e entryM) key() string { return "" }
+func (e entryM) val() Value { return member }
+func (e entryM) hasVal() bool { return true }
+func (e *entryM) setVal(val Value) {
+	if !isMember(val) { panic("set nodes hold no values.") }
+}
+
+type entryKM struct {
+	key_ string
+}
+func (e entryKM) key() string { return e.key_ }
+func (e entryKM) val() Value { return member }
+func (e entryKM) hasVal() bool { return true }
+func (e *entryKM) setVal(val Value) {
+	if !isMember(val) { panic("set nodes hold no values.") }
+}
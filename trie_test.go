@@ -4,11 +4,15 @@ import (
 	"testing"
 	"testing/quick"
 	"fmt"
+	"math"
 	"os"
 	"rand"
 	"reflect"
 	"runtime"
 	"runtime/pprof"
+	"sort"
+	"strings"
+	"unsafe"
 )
 
 func slowcount(bits uint64) int {
@@ -341,6 +345,32 @@ func TestBitmapWith(t *testing.T) {
 	}
 }
 
+func TestBitmapWithTally(t *testing.T) {
+	// Each kind of bitmap counts the copy with makes as a node of its own kind.
+	for _, prefix := range []string{"", "k"} {
+		for _, full := range []bool{false, true} {
+			m := Dict{}
+			if full { m = m.Assoc(prefix, -1) }
+			for i := 0; i < 10; i++ {
+				m = m.Assoc(prefix + string([]byte{byte('!' + 9*i)}), i)
+			}
+			var kind int
+			switch m.t.(type) {
+			case *bitmap_: kind = kBitmap_
+			case *bitmapK: kind = kBitmapK
+			case *bitmapV: kind = kBitmapV
+			case *bitmapKV: kind = kBitmapKV
+			default: t.Fatalf("Expected a bitmap, got %T", m.t)
+			}
+			before := Cumulative[kind]
+			m.t.with(1, 0x7e, leaf("", 10))
+			if Cumulative[kind] != before + 1 {
+				t.Errorf("Expected variant %d to count 1 more, got %d", kind, Cumulative[kind] - before)
+			}
+		}
+	}
+}
+
 func TestEmptyTrie(t *testing.T) {
 	m := Dict{}
 	if m.Count() != 0 {
@@ -437,6 +467,167 @@ func TestWithoutTrie(t *testing.T) {
 	}
 }
 
+func TestWithoutValueCount(t *testing.T) {
+	// A node with a value and 3 sub-tries is a bag, and with 10 spread out ones, a bitmap.
+	for _, n := range []int{3, 10} {
+		for _, prefix := range []string{"", "k"} {
+			m := Dict{}.Assoc(prefix, -1)
+			for i := 0; i < n; i++ {
+				m = m.Assoc(prefix + string([]byte{byte('!' + 9*i)}) + "x", i)
+			}
+			w := m.Without(prefix)
+			if w.Count() != n {
+				t.Errorf("Removing %q from %d keys: expected Count == %d, got %d", prefix, n+1, n, w.Count())
+			}
+		}
+	}
+}
+
+func TestHighCriticalBytes(t *testing.T) {
+	// Bytes >= 0x80 are bytes of a key, and not code points.  9 spread out sub-tries make a
+	// bitmap.
+	m := Dict{}
+	for i := 0; i < 9; i++ {
+		m = m.Assoc("k" + string([]byte{byte(0x80 + 7*i)}) + "x", i)
+	}
+	found := 0
+	m.Foreach(func(key string, val Value) {
+		if ex := "k" + string([]byte{byte(0x80 + 7*val.(int))}) + "x"; key != ex {
+			t.Errorf("Expected key %q for %d, got %q", ex, val.(int), key)
+		}
+		found++
+	})
+	if found != m.Count() { t.Errorf("Foreach found %d of %d keys", found, m.Count()) }
+
+	// Removing a value, or all but one sub-trie, moves the critical byte into a key.
+	m = Dict{}.Assoc("a", 0).Assoc("a\xfec", 1)
+	if v, ok := m.Without("a").ValueAt("a\xfec"); !ok || v.(int) != 1 {
+		t.Errorf("Expected 1 at \"a\\xfec\", got %v", v)
+	}
+	m = Dict{}.Assoc("a\xfeb", 0).Assoc("a\xfec", 1).Assoc("a\x81", 2)
+	if v, ok := m.Without("a\x81").ValueAt("a\xfec"); !ok || v.(int) != 1 {
+		t.Errorf("Expected 1 at \"a\\xfec\", got %v", v)
+	}
+}
+
+func TestBitmapWords(t *testing.T) {
+	// A bitmap whose sub-tries are in each of the words of its bitmap.
+	cbs := []byte{0x45, 0x50, 0x60, 0x70, 0x90, 0xa0, 0xb0, 0xd0, 0xe0, 0xfe}
+	m := Dict{}
+	for i, cb := range cbs {
+		m = m.Assoc(string([]byte{cb}), i)
+	}
+	checkTrie(m.t, len(cbs), expanse(0x45, 0xfe), 1, t)
+	checkExpanse(m.t.expanseWithout(0x45), expanse(0x50, 0xfe), t)
+	checkExpanse(m.t.expanseWithout(0xfe), expanse(0x45, 0xe0), t)
+	count := 0
+	m.t.withsubs(0, 256, func(cb byte, t itrie) { count++ })
+	if count != len(cbs) { t.Errorf("Expected %d sub-tries, got %d", len(cbs), count) }
+
+	m = m.Without("\x45").Without("\xfe")
+	if m.Count() != len(cbs) - 2 { t.Errorf("Expected Count == %d, got %d", len(cbs) - 2, m.Count()) }
+	for i, cb := range cbs[1:len(cbs)-1] {
+		if v, ok := m.ValueAt(string([]byte{cb})); !ok || v.(int) != i+1 {
+			t.Errorf("Expected %d at %x, got %v", i+1, cb, v)
+		}
+	}
+}
+
+func TestCriticalByteFF(t *testing.T) {
+	// A sub-trie at 0xff, added last and removed first, in a bag, a span and a bitmap.
+	for _, cbs := range []string{"\x01\x02\xff", "\xf8\xf9\xfa\xfb\xfc\xfd\xfe\xff",
+		"\x01\x20\x40\x60\x80\xa0\xc0\xe0\xff"} {
+		m := Dict{}
+		for i := 0; i < len(cbs); i++ {
+			m = m.Assoc("k" + cbs[i:i+1], i)
+		}
+		for n, m := range map[int]Dict{len(cbs): m, len(cbs)-1: m.Without("k\xff")} {
+			count := 0
+			m.t.withsubs(0, 256, func(cb byte, t itrie) { count++ })
+			if count != n || m.Count() != n {
+				t.Errorf("%q: expected %d sub-tries, got %d, and Count %d", cbs, n, count, m.Count())
+			}
+			for i := 0; i < n; i++ {
+				if v, ok := m.ValueAt("k" + cbs[i:i+1]); !ok || v.(int) != i {
+					t.Errorf("%q: expected %d at %x, got %v", cbs, i, cbs[i], v)
+				}
+			}
+		}
+	}
+}
+
+func TestWithoutAbsentKey(t *testing.T) {
+	m1 := Dict{}.Assoc("a", 1)
+	m3 := m1.Assoc("ab", 2).Assoc("ac", 3)
+	for _, m := range []Dict{m1, m3} {
+		for _, key := range []string{"", "b", "abc", "ad", "acd"} {
+			if w := m.Without(key); w.Count() != m.Count() || w.t != m.t {
+				t.Errorf("Removing absent %q from %d keys changed the Dict", key, m.Count())
+			}
+		}
+	}
+}
+
+func TestWithoutBelowSpanAndBitmap(t *testing.T) {
+	// "p" has a value, and 10 sub-tries of 2 keys each, close together in a span or spread
+	// out in a bitmap.  Removing one of those keys leaves the sub-trie in place.
+	for _, step := range []int{1, 9} {
+		m := Dict{}.Assoc("p", -1)
+		for i := 0; i < 10; i++ {
+			cb := string([]byte{byte('!' + step*i)})
+			m = m.Assoc("p" + cb + "0", i).Assoc("p" + cb + "1", i)
+		}
+		w := m.Without("p!0")
+		if w.Count() != 20 { t.Errorf("Expected Count == 20, got %d", w.Count()) }
+		if v, ok := w.ValueAt("p"); !ok || v.(int) != -1 { t.Errorf("Expected -1 at p, got %v", v) }
+		if v, ok := w.ValueAt("p!1"); !ok || v.(int) != 0 { t.Errorf("Expected 0 at p!1, got %v", v) }
+	}
+}
+
+func TestSpanShrinkKey(t *testing.T) {
+	// Spans don't usually get this small, but one that does collapses into the sub-trie left.
+	b := bag1("", nil, false, 'a', leaf("x", 1))
+	s := span(b, b.expanse().with('c'), 'c', leaf("y", 2))
+	if r := s.without('a', nil); r.key() != "cy" {
+		t.Errorf("Expected key \"cy\", got %q", r.key())
+	}
+}
+
+func TestEntryAtDivergentKey(t *testing.T) {
+	// "c" and "xd" part from the root's key "ab", so they mustn't match "abc" and "abd" below it.
+	m := Dict{}.Assoc("abc", 1).Assoc("abd", 2)
+	for _, key := range []string{"c", "xd", "ac", "a"} {
+		if m.Contains(key) { t.Errorf("Expected no entry @ %q", key) }
+	}
+	if v, ok := m.ValueAt("abd"); !ok || v.(int) != 2 { t.Errorf("Expected 2 at abd, got %v", v) }
+}
+
+func TestForeachSmallNodes(t *testing.T) {
+	// Bags and spans are allocated with only as many sub-tries as they use.
+	for n := 1; n <= 12; n++ {
+		for _, prefix := range []string{"", "k"} {
+			m := Dict{}.Assoc(prefix, -1)
+			for i := 0; i < n; i++ {
+				m = m.Assoc(prefix + string([]byte{byte('a' + i)}), i)
+			}
+			found := 0
+			m.Foreach(func(key string, val Value) {
+				if i := val.(int); i >= 0 && key != prefix + string([]byte{byte('a' + i)}) {
+					t.Errorf("Expected key %q for %d, got %q", prefix + string([]byte{byte('a' + i)}), i, key)
+				}
+				found++
+			})
+			if found != n+1 { t.Errorf("Foreach found %d of %d keys", found, n+1) }
+			// Removing the value of a node with one sub-trie collapses it.
+			if n == 1 {
+				if v, ok := m.Without(prefix).ValueAt(prefix + "a"); !ok || v.(int) != 0 {
+					t.Errorf("Expected 0 at %q, got %v", prefix + "a", v)
+				}
+			}
+		}
+	}
+}
+
 func TestIterTrie(t *testing.T) {
 	var keys [256]string
 	m := Dict{}
@@ -493,6 +684,1273 @@ func TestIterTrie(t *testing.T) {
 		t.Errorf("TestIter: only iterated %d of %d items via Iter.", count, m.Count())
 	}
 }
+func TestAssocAllocs(t *testing.T) {
+	// Each operation on a path shallower than a stack segment allocates only the nodes it
+	// copies, one for each of the depth nodes on the path, and never the stack.
+	const depth = 10
+	const rounds = 100
+	d := Dict{}
+	for i := 1; i <= depth; i++ {
+		d = d.Assoc(strings.Repeat("x", i), i)
+	}
+	key := strings.Repeat("x", depth)
+	var val Value = "v"
+	before := runtime.MemStats.Mallocs
+	for i := 0; i < rounds; i++ { d.Assoc(key, val) }
+	if n := (runtime.MemStats.Mallocs - before) / rounds; n > depth {
+		t.Errorf("Expected at most %d allocations per Assoc, got %d", depth, n)
+	}
+	before = runtime.MemStats.Mallocs
+	for i := 0; i < rounds; i++ { d.Without(key) }
+	if n := (runtime.MemStats.Mallocs - before) / rounds; n > depth {
+		t.Errorf("Expected at most %d allocations per Without, got %d", depth, n)
+	}
+	set := func(Value, bool) (Value, bool) { return val, true }
+	before = runtime.MemStats.Mallocs
+	for i := 0; i < rounds; i++ { d.Update(key, set) }
+	if n := (runtime.MemStats.Mallocs - before) / rounds; n > depth {
+		t.Errorf("Expected at most %d allocations per Update, got %d", depth, n)
+	}
+}
+func TestConcurrentAssocWithout(t *testing.T) {
+	const workers = 16
+	const perWorker = 2000
+	const numBase = 1000
+	const chain = 2*segSize
+
+	// The chain of keys "x", "xx", "xxx"... makes a path deeper than a single stack segment.
+	base := Dict{}
+	for i := 0; i < numBase; i++ {
+		base = base.Assoc(fmt.Sprintf("base%d", i), i)
+	}
+	for i := 1; i <= chain; i++ {
+		base = base.Assoc(strings.Repeat("x", i), i)
+	}
+
+	done := make(chan bool)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			defer func() { done <- true }()
+			d := base
+			removed := 0
+			for i := 0; i < perWorker; i++ {
+				d = d.Assoc(fmt.Sprintf("w%d/%d", w, i), i)
+				if i < numBase && i % workers == w {
+					d = d.Without(fmt.Sprintf("base%d", i)); removed++
+				}
+			}
+			d = d.Assoc(strings.Repeat("x", chain+w+1), w)
+			d = d.Without(strings.Repeat("x", w+1))
+			if ex := numBase + chain + perWorker - removed; d.Count() != ex {
+				t.Errorf("worker %d: expected Count == %d, got %d", w, ex, d.Count())
+			}
+			for i := 0; i < perWorker; i++ {
+				if v, ok := d.ValueAt(fmt.Sprintf("w%d/%d", w, i)); !ok || v.(int) != i {
+					t.Errorf("worker %d: expected %d at w%d/%d, got %v", w, i, w, i, v)
+				}
+			}
+			for i := 0; i < numBase; i++ {
+				if d.Contains(fmt.Sprintf("base%d", i)) == (i % workers == w) {
+					t.Errorf("worker %d: wrong membership for base%d", w, i)
+				}
+			}
+			if d.Contains(strings.Repeat("x", w+1)) || !d.Contains(strings.Repeat("x", chain+w+1)) {
+				t.Errorf("worker %d: wrong membership for deep chain keys", w)
+			}
+		}(w)
+	}
+	for w := 0; w < workers; w++ {
+		<-done
+	}
+
+	if base.Count() != numBase + chain {
+		t.Errorf("Expected base.Count() == %d, got %d", numBase + chain, base.Count())
+	}
+	for i := 0; i < numBase; i++ {
+		if v, ok := base.ValueAt(fmt.Sprintf("base%d", i)); !ok || v.(int) != i {
+			t.Errorf("Expected %d at base%d, got %v", i, i, v)
+		}
+	}
+}
+
+/*
+ Builds a dict whose keys are drawn from every byte value, with plenty of keys that are
+ prefixes of other keys, so that bags, spans and bitmaps all show up.  Returns the dict and
+ its keys in sorted order.
+*/
+func sortedTestDict(n int) (Dict, []string) {
+	d := Dict{}
+	for i := 0; i < n; i++ {
+		k := make([]byte, rand.Intn(4))
+		for j := range k {
+			if rand.Intn(2) == 0 { k[j] = byte(rand.Intn(256)) } else { k[j] = byte('a' + rand.Intn(4)) }
+		}
+		d = d.Assoc(string(k), i)
+	}
+	keys := make([]string, 0, d.Count())
+	d.Foreach(func(key string, val Value) { keys = append(keys, key) })
+	return d, keys
+}
+
+func TestCursor(t *testing.T) {
+	d, keys := sortedTestDict(5000)
+	if !sort.StringsAreSorted(keys) {
+		t.Errorf("Expected Foreach to visit keys in sorted order")
+	}
+
+	c := d.Cursor()
+	i := 0
+	for c.Next() {
+		if i >= len(keys) || c.Key() != keys[i] {
+			t.Errorf("Next: expected key #%d to be %q, got %q", i, keys[i], c.Key())
+			break
+		}
+		if v, ok := d.ValueAt(c.Key()); !ok || v != c.Value() {
+			t.Errorf("Next: wrong value at %q", c.Key())
+		}
+		i++
+	}
+	if i != len(keys) || c.Valid() {
+		t.Errorf("Next: visited %d of %d keys", i, len(keys))
+	}
+
+	i = len(keys)
+	for c.Prev() {
+		i--
+		if i < 0 || c.Key() != keys[i] {
+			t.Errorf("Prev: expected key #%d to be %q, got %q", i, keys[i], c.Key())
+			break
+		}
+	}
+	if i != 0 {
+		t.Errorf("Prev: stopped at key #%d", i)
+	}
+
+	for n := 0; n < 2000; n++ {
+		probe := string([]byte{byte(rand.Intn(256)), byte('a' + rand.Intn(4))})[:rand.Intn(3)]
+		i := sort.SearchStrings(keys, probe)
+		if ok := c.Seek(probe); ok != (i < len(keys)) {
+			t.Errorf("Seek(%q): expected %v, got %v", probe, i < len(keys), ok)
+			continue
+		}
+		if i == len(keys) { continue }
+		if c.Key() != keys[i] {
+			t.Errorf("Seek(%q): expected %q, got %q", probe, keys[i], c.Key())
+			continue
+		}
+		if c.Prev() != (i > 0) || (i > 0 && c.Key() != keys[i-1]) {
+			t.Errorf("Seek(%q) then Prev: expected %d", probe, i-1)
+		}
+	}
+
+	empty := Dict{}.Cursor()
+	if empty.Next() || empty.Prev() || empty.Seek("") || empty.Valid() {
+		t.Errorf("Expected a cursor over an empty dict to stay unpositioned")
+	}
+}
+
+func TestWithPrefix(t *testing.T) {
+	d := Dict{}
+	for i := 0; i < 50; i++ {
+		d = d.Assoc(fmt.Sprintf("user/%d/name", i), i)
+		d = d.Assoc(fmt.Sprintf("user/%d/email", i), i)
+	}
+	d = d.Assoc("user/4", "four")
+	u := d.WithPrefix("user/4")
+	if u.Count() != 23 || d.CountPrefix("user/4") != 23 {
+		t.Errorf("Expected 23 entries under user/4, got %d (%d)", u.Count(), d.CountPrefix("user/4"))
+	}
+	if v, ok := u.ValueAt("user/42/email"); !ok || v.(int) != 42 {
+		t.Errorf("Expected 42 at user/42/email, got %v", v)
+	}
+	if u.Contains("user/5/name") {
+		t.Errorf("Expected user/5/name to be outside of user/4")
+	}
+	if d.WithPrefix("").Count() != d.Count() || d.WithPrefix("nobody").Count() != 0 {
+		t.Errorf("Expected the empty prefix to hold everything and a missing one nothing")
+	}
+
+	r, keys := sortedTestDict(5000)
+	for n := 0; n < 500; n++ {
+		prefix := string([]byte{byte('a' + rand.Intn(4)), byte(rand.Intn(256))})[:rand.Intn(3)]
+		var ex []string
+		for _, k := range keys {
+			if strings.HasPrefix(k, prefix) { ex = append(ex, k) }
+		}
+		p := r.WithPrefix(prefix)
+		if p.Count() != len(ex) || r.CountPrefix(prefix) != len(ex) {
+			t.Errorf("WithPrefix(%q): expected %d entries, got %d", prefix, len(ex), p.Count())
+			continue
+		}
+		i := 0
+		p.Foreach(func(key string, val Value) {
+			if i < len(ex) && key != ex[i] {
+				t.Errorf("WithPrefix(%q): expected %q, got %q", prefix, ex[i], key)
+			}
+			i++
+		})
+	}
+}
+
+func TestRange(t *testing.T) {
+	d, keys := sortedTestDict(5000)
+	probe := func() string {
+		return string([]byte{byte('a' + rand.Intn(4)), byte(rand.Intn(256)), byte('a' + rand.Intn(4))})[:rand.Intn(4)]
+	}
+	for n := 0; n < 500; n++ {
+		lo, hi := probe(), probe()
+		var ex []string
+		for _, k := range keys {
+			if k >= lo && (hi == "" || k < hi) { ex = append(ex, k) }
+		}
+		i := 0
+		d.Range(lo, hi, func(key string, val Value) {
+			if i >= len(ex) || key != ex[i] {
+				t.Errorf("Range(%q, %q): unexpected key #%d %q", lo, hi, i, key)
+			}
+			i++
+		})
+		if i != len(ex) {
+			t.Errorf("Range(%q, %q): expected %d keys, got %d", lo, hi, len(ex), i)
+		}
+		s := d.Slice(lo, hi)
+		if s.Count() != len(ex) {
+			t.Errorf("Slice(%q, %q): expected Count == %d, got %d", lo, hi, len(ex), s.Count())
+		}
+		i = 0
+		s.Foreach(func(key string, val Value) {
+			if i >= len(ex) || key != ex[i] {
+				t.Errorf("Slice(%q, %q): unexpected key #%d %q", lo, hi, i, key)
+			} else if v, _ := d.ValueAt(key); v != val {
+				t.Errorf("Slice(%q, %q): wrong value at %q", lo, hi, key)
+			}
+			i++
+		})
+	}
+	if s := d.Slice("", ""); s.t != d.t {
+		t.Errorf("Expected an unbounded Slice to share the whole trie")
+	}
+}
+
+func TestFloorCeiling(t *testing.T) {
+	d, keys := sortedTestDict(5000)
+	check := func(name, probe string, i int, key string, val Value, ok bool) {
+		if ok != (i >= 0 && i < len(keys)) {
+			t.Errorf("%s(%q): expected found == %v", name, probe, !ok)
+		} else if ok && key != keys[i] {
+			t.Errorf("%s(%q): expected %q, got %q", name, probe, keys[i], key)
+		} else if v, _ := d.ValueAt(key); ok && v != val {
+			t.Errorf("%s(%q): wrong value", name, probe)
+		}
+	}
+	for n := 0; n < 2000; n++ {
+		probe := string([]byte{byte('a' + rand.Intn(4)), byte(rand.Intn(256)), byte('a' + rand.Intn(4))})[:rand.Intn(4)]
+		i := sort.SearchStrings(keys, probe)
+		exact := i < len(keys) && keys[i] == probe
+		k, v, ok := d.Ceiling(probe)
+		check("Ceiling", probe, i, k, v, ok)
+		k, v, ok = d.Lower(probe)
+		check("Lower", probe, i-1, k, v, ok)
+		k, v, ok = d.Floor(probe)
+		if exact { check("Floor", probe, i, k, v, ok) } else { check("Floor", probe, i-1, k, v, ok) }
+		k, v, ok = d.Higher(probe)
+		if exact { check("Higher", probe, i+1, k, v, ok) } else { check("Higher", probe, i, k, v, ok) }
+	}
+	if _, _, ok := (Dict{}).Floor("a"); ok {
+		t.Errorf("Expected no Floor in an empty dict")
+	}
+}
+
+func TestRankSelect(t *testing.T) {
+	d, keys := sortedTestDict(5000)
+	for i, k := range keys {
+		if r := d.Rank(k); r != i {
+			t.Errorf("Rank(%q): expected %d, got %d", k, i, r)
+		}
+		if key, val := d.Select(i); key != k {
+			t.Errorf("Select(%d): expected %q, got %q", i, k, key)
+		} else if v, _ := d.ValueAt(k); v != val {
+			t.Errorf("Select(%d): wrong value", i)
+		}
+	}
+	for n := 0; n < 2000; n++ {
+		probe := string([]byte{byte('a' + rand.Intn(4)), byte(rand.Intn(256)), byte('a' + rand.Intn(4))})[:rand.Intn(4)]
+		if r, ex := d.Rank(probe), sort.SearchStrings(keys, probe); r != ex {
+			t.Errorf("Rank(%q): expected %d, got %d", probe, ex, r)
+		}
+	}
+	if _, _, ok := d.Nth(len(keys)); ok {
+		t.Errorf("Expected Nth(%d) to be out of range", len(keys))
+	}
+	if k, _, ok := d.Min(); !ok || k != keys[0] {
+		t.Errorf("Min: expected %q, got %q", keys[0], k)
+	}
+	if k, _, ok := d.Max(); !ok || k != keys[len(keys)-1] {
+		t.Errorf("Max: expected %q, got %q", keys[len(keys)-1], k)
+	}
+	if _, _, ok := (Dict{}).Min(); ok {
+		t.Errorf("Expected no Min in an empty dict")
+	}
+}
+
+func TestPrefixesOf(t *testing.T) {
+	d := Dict{}
+	for _, k := range []string{"", "/", "/api", "/api/v1", "/api/v1/users", "/apiary", "/static"} {
+		d = d.Assoc(k, k)
+	}
+	var got []string
+	d.PrefixesOf("/api/v1/users/42", func(key string, val Value) {
+		if val.(string) != key { t.Errorf("PrefixesOf: wrong value at %q", key) }
+		got = append(got, key)
+	})
+	if ex := []string{"", "/", "/api", "/api/v1", "/api/v1/users"}; !reflect.DeepEqual(got, ex) {
+		t.Errorf("PrefixesOf: expected %v, got %v", ex, got)
+	}
+	if k, _, ok := d.LongestPrefixOf("/api/v2"); !ok || k != "/api" {
+		t.Errorf("LongestPrefixOf(/api/v2): expected /api, got %q", k)
+	}
+	if k, _, ok := d.LongestPrefixOf("/apiary"); !ok || k != "/apiary" {
+		t.Errorf("LongestPrefixOf(/apiary): expected /apiary, got %q", k)
+	}
+	if k, _, ok := d.Without("").LongestPrefixOf("x"); ok {
+		t.Errorf("LongestPrefixOf(x): expected nothing, got %q", k)
+	}
+
+	r, keys := sortedTestDict(5000)
+	for n := 0; n < 1000; n++ {
+		s := string([]byte{byte('a' + rand.Intn(4)), byte(rand.Intn(256)), byte('a' + rand.Intn(4)), byte(rand.Intn(256))})[:rand.Intn(5)]
+		var ex []string
+		for i := 0; i <= len(s); i++ {
+			if j := sort.SearchStrings(keys, s[:i]); j < len(keys) && keys[j] == s[:i] { ex = append(ex, s[:i]) }
+		}
+		var got []string
+		r.PrefixesOf(s, func(key string, val Value) { got = append(got, key) })
+		if len(got) != len(ex) || (len(ex) > 0 && !reflect.DeepEqual(got, ex)) {
+			t.Errorf("PrefixesOf(%q): expected %q, got %q", s, ex, got)
+		}
+		k, _, ok := r.LongestPrefixOf(s)
+		if ok != (len(ex) > 0) || (ok && k != ex[len(ex)-1]) {
+			t.Errorf("LongestPrefixOf(%q): got %q", s, k)
+		}
+	}
+}
+
+func TestMergeIntersectDifference(t *testing.T) {
+	base, _ := sortedTestDict(3000)
+	// Two versions sharing most of their structure with base, and each other.
+	derive := func(seed int) (Dict, map[string]int) {
+		d := base
+		for i := 0; i < 300; i++ {
+			k := make([]byte, rand.Intn(5))
+			for j := range k { k[j] = byte('a' + rand.Intn(4)) }
+			if rand.Intn(3) == 0 { d = d.Without(string(k)) } else { d = d.Assoc(string(k), seed + i) }
+		}
+		m := make(map[string]int)
+		d.Foreach(func(key string, val Value) { m[key] = val.(int) })
+		return d, m
+	}
+	a, am := derive(100000)
+	b, bm := derive(200000)
+	check := func(op string, d Dict, ex map[string]int) {
+		if d.Count() != len(ex) { t.Errorf("%s: expected %d entries, got %d", op, len(ex), d.Count()) }
+		d.Foreach(func(key string, val Value) {
+			if v, ok := ex[key]; !ok || v != val.(int) { t.Errorf("%s: unexpected %q = %v", op, key, val) }
+		})
+	}
+
+	resolve := func(key string, x, y Value) Value {
+		if am[key] != x.(int) || bm[key] != y.(int) { t.Errorf("Merge: bad resolve of %q", key) }
+		if x == y { return y }
+		return -y.(int)
+	}
+	ex := make(map[string]int)
+	for k, v := range am { ex[k] = v }
+	for k, v := range bm {
+		if w, ok := ex[k]; ok && w != v { ex[k] = -v } else { ex[k] = v }
+	}
+	check("Merge", a.Merge(b, resolve), ex)
+
+	ex = make(map[string]int)
+	for k, v := range am {
+		if _, ok := bm[k]; ok { ex[k] = v }
+	}
+	check("Intersect", a.Intersect(b), ex)
+
+	ex = make(map[string]int)
+	for k, v := range am {
+		if _, ok := bm[k]; !ok { ex[k] = v }
+	}
+	check("Difference", a.Difference(b), ex)
+
+	// Identical tries are reused without being looked into.
+	if a.Merge(a, func(string, Value, Value) Value { panic("resolve called") }).t != a.t {
+		t.Errorf("Merge with itself should return the same trie")
+	}
+	if a.Intersect(a).t != a.t { t.Errorf("Intersect with itself should return the same trie") }
+	if a.Difference(a).Count() != 0 { t.Errorf("Difference with itself should be empty") }
+	if a.Merge(Dict{}, nil).t != a.t || (Dict{}).Merge(a, nil).t != a.t {
+		t.Errorf("Merge with an empty dict should return the other")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old, keys := sortedTestDict(3000)
+	old = old.Assoc("slice", []int{1}).Assoc("other", []int{1})
+	om := make(map[string]Value)
+	old.Foreach(func(key string, val Value) { om[key] = val })
+	nm := make(map[string]Value)
+	for k, v := range om { nm[k] = v }
+	d := old
+	for i := 0; i < 200; i++ {
+		k := keys[rand.Intn(len(keys))]
+		if rand.Intn(2) == 0 { k += "z" }
+		switch rand.Intn(3) {
+		case 0: d = d.Without(k); nm[k] = nil, false
+		case 1: d = d.Assoc(k, -i); nm[k] = -i
+		case 2: d = d.Assoc(k, om[k]); nm[k] = om[k]
+		}
+	}
+	// Values other than the basic types count as changed unless carried over unchanged.
+	d = d.Assoc("slicer", 0).Assoc("other", []int{1})
+	nm["slicer"] = 0
+
+	var ex []string
+	for k, v := range nm {
+		if w, ok := om[k]; !ok {
+			ex = append(ex, fmt.Sprint(k, " Added"))
+		} else if k != "slice" && (k == "other" || v != w) {
+			ex = append(ex, fmt.Sprint(k, " Changed"))
+		}
+	}
+	for k, _ := range om {
+		if _, ok := nm[k]; !ok { ex = append(ex, fmt.Sprint(k, " Removed")) }
+	}
+	sort.Strings(ex)
+	var got, order []string
+	Diff(old, d, func(key string, kind ChangeKind, oldVal, newVal Value) {
+		order = append(order, key)
+		switch kind {
+		case Added: if oldVal != nil || !d.Contains(key) || old.Contains(key) { t.Errorf("Diff: bad Added %q", key) }
+		case Removed: if newVal != nil || d.Contains(key) || !old.Contains(key) { t.Errorf("Diff: bad Removed %q", key) }
+		}
+		got = append(got, fmt.Sprint(key, " ", kind))
+	})
+	if !sort.StringsAreSorted(order) { t.Errorf("Diff: changes not in key order") }
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, ex) {
+		t.Errorf("Diff: expected %d changes, got %d", len(ex), len(got))
+	}
+	n := 0
+	Diff(d, d, func(string, ChangeKind, Value, Value) { n++ })
+	Diff(Dict{}, Dict{}, func(string, ChangeKind, Value, Value) { n++ })
+	if n != 0 { t.Errorf("Diff of identical dicts reported %d changes", n) }
+	Diff(Dict{}, d, func(key string, kind ChangeKind, oldVal, newVal Value) {
+		if kind != Added { t.Errorf("Diff from empty: %q %v", key, kind) }
+		n++
+	})
+	if n != d.Count() { t.Errorf("Diff from empty: expected %d additions, got %d", d.Count(), n) }
+}
+
+func TestTransient(t *testing.T) {
+	base, keys := sortedTestDict(3000)
+	bm := make(map[string]Value)
+	base.Foreach(func(key string, val Value) { bm[key] = val })
+	m := make(map[string]Value)
+	for k, v := range bm { m[k] = v }
+
+	tr := base.Transient()
+	for i := 0; i < 20000; i++ {
+		k := keys[rand.Intn(len(keys))]
+		if rand.Intn(2) == 0 { k += string([]byte{byte(rand.Intn(256))}) }
+		if rand.Intn(3) == 0 {
+			tr.Without(k); m[k] = nil, false
+		} else {
+			tr.Assoc(k, -i); m[k] = -i
+		}
+	}
+	if tr.Count() != len(m) { t.Errorf("Transient: expected %d entries, got %d", len(m), tr.Count()) }
+	d := tr.Persistent()
+	if d.Count() != len(m) { t.Errorf("Persistent: expected %d entries, got %d", len(m), d.Count()) }
+	d.Foreach(func(key string, val Value) {
+		if v, ok := m[key]; !ok || v != val { t.Errorf("Persistent: unexpected %q = %v", key, val) }
+	})
+	// The Dict the Transient came from is untouched.
+	if base.Count() != len(bm) { t.Errorf("Transient changed its source dict") }
+	base.Foreach(func(key string, val Value) {
+		if v, ok := bm[key]; !ok || v != val { t.Errorf("Transient changed %q in its source dict", key) }
+	})
+	// And so is the one it produced, when it's made transient again.
+	tr2 := d.Transient()
+	for _, k := range keys { tr2.Assoc(k, "again") }
+	for k, v := range m {
+		if val, ok := d.ValueAt(k); !ok || val != v { t.Errorf("second Transient changed %q", k) }
+	}
+	if tr2.Persistent().Count() < d.Count() { t.Errorf("second Transient lost entries") }
+
+	defer func() {
+		if recover() == nil { t.Errorf("Transient used after Persistent should panic") }
+	}()
+	tr.Assoc("x", 1)
+}
+
+func TestFromSorted(t *testing.T) {
+	d, keys := sortedTestDict(5000)
+	i := 0
+	next := func() (string, Value, bool) {
+		if i == len(keys) { return "", nil, false }
+		i++
+		v, _ := d.ValueAt(keys[i-1])
+		return keys[i-1], v, true
+	}
+	r, err := FromSorted(next)
+	if err != nil { t.Fatalf("FromSorted: %v", err) }
+	if r.Count() != d.Count() { t.Errorf("FromSorted: expected %d entries, got %d", d.Count(), r.Count()) }
+	var got []string
+	r.Foreach(func(key string, val Value) {
+		if v, _ := d.ValueAt(key); v != val { t.Errorf("FromSorted: wrong value at %q", key) }
+		got = append(got, key)
+	})
+	if !reflect.DeepEqual(got, keys) { t.Errorf("FromSorted: keys differ") }
+
+	from := func(keys ...string) (Dict, os.Error) {
+		i := 0
+		return FromSorted(func() (string, Value, bool) {
+			if i == len(keys) { return "", nil, false }
+			i++
+			return keys[i-1], i, true
+		})
+	}
+	if e, err := from(); err != nil || e.Count() != 0 { t.Errorf("FromSorted of nothing: %v", err) }
+	if _, err := from("a", "b", "b"); err == nil { t.Errorf("FromSorted should reject a duplicate key") }
+	if _, err := from("a", "c", "b"); err == nil { t.Errorf("FromSorted should reject keys out of order") }
+	if e, err := from("", "a", "ab", "abc", "b"); err != nil || e.Count() != 5 || !e.Contains("") || !e.Contains("abc") {
+		t.Errorf("FromSorted of nested keys: %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	d, keys := sortedTestDict(3000)
+	m := make(map[string]Value)
+	d.Foreach(func(key string, val Value) { m[key] = val })
+	for i := 0; i < 5000; i++ {
+		k := keys[rand.Intn(len(keys))]
+		if rand.Intn(2) == 0 { k += string([]byte{byte(rand.Intn(256))}) }
+		op := rand.Intn(3)
+		d = d.Update(k, func(old Value, present bool) (Value, bool) {
+			if v, ok := m[k]; ok != present || v != old { t.Errorf("Update(%q): got %v, %v", k, old, present) }
+			switch op {
+			case 0: return nil, false
+			case 1: return i, true
+			}
+			return old, present
+		})
+		switch op {
+		case 0: m[k] = nil, false
+		case 1: m[k] = i
+		}
+	}
+	if d.Count() != len(m) { t.Errorf("Update: expected %d entries, got %d", len(m), d.Count()) }
+	d.Foreach(func(key string, val Value) {
+		if v, ok := m[key]; !ok || v != val { t.Errorf("Update: unexpected %q = %v", key, val) }
+	})
+	// Leaving the value alone, or removing a missing key, gives back the same trie.
+	k := keys[len(keys)/2]
+	d = d.Assoc(k, []int{1})
+	same := func(old Value, present bool) (Value, bool) { return old, present }
+	if d.Update(k, same).t != d.t || d.Update(k + "\xff\xff\xff\xff", same).t != d.t {
+		t.Errorf("Update that changes nothing should return the same trie")
+	}
+	if d.Update(k, func(old Value, present bool) (Value, bool) { return []int{1}, true }).t == d.t {
+		t.Errorf("Update with a new value should change the trie")
+	}
+	e := Dict{}.Update("a", func(old Value, present bool) (Value, bool) { return 1, true })
+	if v, ok := e.ValueAt("a"); !ok || v != 1 { t.Errorf("Update of an empty dict: %v", v) }
+}
+
+func TestReport(t *testing.T) {
+	d, keys := sortedTestDict(1000)
+	for n := 0; n < 1000; n++ {
+		k := keys[rand.Intn(len(keys))]
+		if rand.Intn(2) == 0 { k += "\xff\xff\xff\xff" }
+		v, had := d.ValueAt(k)
+		n0, n1 := d.Count(), d.Count()
+		if had { n0-- } else { n1++ }
+		r, old, replaced := d.AssocReport(k, -n)
+		if replaced != had || old != v { t.Errorf("AssocReport(%q): got %v, %v", k, old, replaced) }
+		if x, _ := r.ValueAt(k); x != -n || r.Count() != n1 {
+			t.Errorf("AssocReport(%q) didn't set the value", k)
+		}
+		r, old, removed := d.WithoutReport(k)
+		if removed != had || old != v { t.Errorf("WithoutReport(%q): got %v, %v", k, old, removed) }
+		if r.Contains(k) || r.Count() != n0 {
+			t.Errorf("WithoutReport(%q) didn't remove the key", k)
+		}
+		if !had && r.t != d.t { t.Errorf("WithoutReport of a missing key should return the same trie") }
+	}
+	// Storing the value a key already has changes nothing.
+	k := keys[0]
+	v, _ := d.ValueAt(k)
+	if d.Assoc(k, v).t != d.t { t.Errorf("Assoc of the same value should return the same trie") }
+	if r, _, replaced := d.AssocReport(k, v); r.t != d.t || !replaced {
+		t.Errorf("AssocReport of the same value should return the same trie")
+	}
+}
+
+func TestWithoutPrefixGraft(t *testing.T) {
+	d, keys := sortedTestDict(3000)
+	m := make(map[string]Value)
+	d.Foreach(func(key string, val Value) { m[key] = val })
+	check := func(op string, r Dict, ex map[string]Value) {
+		if r.Count() != len(ex) { t.Errorf("%s: expected %d entries, got %d", op, len(ex), r.Count()) }
+		r.Foreach(func(key string, val Value) {
+			if v, ok := ex[key]; !ok || v != val { t.Errorf("%s: unexpected %q = %v", op, key, val) }
+		})
+	}
+	sub := Dict{}.Assoc("", "root").Assoc("x", "x").Assoc("xy", "xy").Assoc("z", "z")
+	for n := 0; n < 200; n++ {
+		p := keys[rand.Intn(len(keys))]
+		p = p[:rand.Intn(len(p)+1)]
+		q := keys[rand.Intn(len(keys))] + "q"
+		q = q[:rand.Intn(len(q)+1)]
+
+		ex := make(map[string]Value)
+		for k, v := range m {
+			if !strings.HasPrefix(k, p) { ex[k] = v }
+		}
+		without := d.WithoutPrefix(p)
+		check(fmt.Sprintf("WithoutPrefix(%q)", p), without, ex)
+
+		sub.Foreach(func(key string, val Value) { ex[p + key] = val })
+		check(fmt.Sprintf("Graft(%q)", p), d.Graft(p, sub), ex)
+
+		ex = make(map[string]Value)
+		for k, v := range m {
+			if !strings.HasPrefix(k, p) && !strings.HasPrefix(k, q) { ex[k] = v }
+		}
+		for k, v := range m {
+			if strings.HasPrefix(k, p) { ex[q + k[len(p):]] = v }
+		}
+		if p != q && d.CountPrefix(p) > 0 {
+			check(fmt.Sprintf("RenamePrefix(%q, %q)", p, q), d.RenamePrefix(p, q), ex)
+		}
+	}
+	if d.WithoutPrefix("\xff\xff\xff\xff").t != d.t { t.Errorf("WithoutPrefix of a missing prefix should return the same trie") }
+	if d.WithoutPrefix("").Count() != 0 { t.Errorf("WithoutPrefix(\"\") should remove everything") }
+	if r := (Dict{}).Graft("a/", sub); r.Count() != sub.Count() || !r.Contains("a/xy") { t.Errorf("Graft onto an empty dict") }
+}
+
+// Whether a and b are nodes of the same kinds, keys and critical bytes, all the way down.
+func sameShape(a, b itrie) bool {
+	if reflect.Typeof(a) != reflect.Typeof(b) || a.key() != b.key() || a.expanse() != b.expanse() {
+		return false
+	}
+	same := true
+	a.withsubs(0, 256, func(cb byte, sub itrie) { same = same && sameShape(sub, b.subAt(cb)) })
+	return same
+}
+
+func TestFunctional(t *testing.T) {
+	d, keys := sortedTestDict(3000)
+	even := func(key string, val Value) bool { return val.(int) % 2 == 0 }
+	f := d.Filter(even)
+	n := 0
+	d.Foreach(func(key string, val Value) {
+		if even(key, val) { n++ }
+		if even(key, val) != f.Contains(key) { t.Errorf("Filter: wrong membership of %q", key) }
+	})
+	if f.Count() != n { t.Errorf("Filter: expected %d entries, got %d", n, f.Count()) }
+	if d.Filter(func(string, Value) bool { return true }).t != d.t {
+		t.Errorf("Filter that keeps everything should return the same trie")
+	}
+	if d.Filter(func(string, Value) bool { return false }).Count() != 0 {
+		t.Errorf("Filter that keeps nothing should be empty")
+	}
+
+	m := d.MapValues(func(key string, val Value) Value { return key + "!" })
+	if m.Count() != d.Count() { t.Errorf("MapValues: expected %d entries, got %d", d.Count(), m.Count()) }
+	m.Foreach(func(key string, val Value) {
+		if val.(string) != key + "!" { t.Errorf("MapValues: wrong value at %q", key) }
+	})
+	// Removing keys leaves nodes that makeNode wouldn't choose; MapValues keeps them as they are.
+	w := d
+	for _, key := range keys[:len(keys)/2] { w = w.Without(key) }
+	if m := w.MapValues(func(key string, val Value) Value { return key }); !sameShape(w.t, m.t) {
+		t.Errorf("MapValues: the trie changed shape")
+	}
+
+	sum := d.Reduce(0, func(acc Value, key string, val Value) Value { return acc.(int) + val.(int) })
+	ex := 0
+	d.Foreach(func(key string, val Value) { ex += val.(int) })
+	if sum.(int) != ex { t.Errorf("Reduce: expected %d, got %v", ex, sum) }
+
+	// Any and All stop at the first entry that decides them.
+	calls := 0
+	target := keys[len(keys)/3]
+	if !d.Any(func(key string, val Value) bool { calls++; return key == target }) || calls != len(keys)/3 + 1 {
+		t.Errorf("Any: expected to stop after %d calls, made %d", len(keys)/3 + 1, calls)
+	}
+	calls = 0
+	if d.All(func(key string, val Value) bool { calls++; return key < target }) || calls != len(keys)/3 + 1 {
+		t.Errorf("All: expected to stop after %d calls, made %d", len(keys)/3 + 1, calls)
+	}
+	if !d.All(func(string, Value) bool { return true }) || (Dict{}).Any(even) || !(Dict{}).All(even) {
+		t.Errorf("Any/All: wrong result")
+	}
+}
+
+func TestParallel(t *testing.T) {
+	d, keys := sortedTestDict(5000)
+	// Joining keys is order-sensitive, so it shows the runs are combined in key order.
+	fold := func(acc Value, key string, val Value) Value { return acc.(string) + key + "," }
+	combine := func(a, b Value) Value { return a.(string) + b.(string) }
+	ex := strings.Join(keys, ",") + ","
+	for _, workers := range []int{0, 1, 2, 3, 8, 32} {
+		if r := d.ParallelFold(workers, "", fold, combine); r.(string) != ex {
+			t.Errorf("ParallelFold with %d workers: wrong result", workers)
+		}
+		m := d.ParallelMapValues(workers, func(key string, val Value) Value { return key + "!" })
+		if m.Count() != d.Count() { t.Errorf("ParallelMapValues: expected %d entries, got %d", d.Count(), m.Count()) }
+		m.Foreach(func(key string, val Value) {
+			if val.(string) != key + "!" { t.Errorf("ParallelMapValues: wrong value at %q", key) }
+		})
+		if !sameShape(d.t, m.t) { t.Errorf("ParallelMapValues with %d workers: the trie changed shape", workers) }
+	}
+	if r := (Dict{}).ParallelFold(4, 0, nil, nil); r.(int) != 0 { t.Errorf("ParallelFold of an empty dict") }
+}
+
+// Whether a and b are the same bytes in memory, and not just equal.
+func sameBytes(a, b string) bool {
+	return len(a) == len(b) &&
+		(*reflect.StringHeader)(unsafe.Pointer(&a)).Data == (*reflect.StringHeader)(unsafe.Pointer(&b)).Data
+}
+
+func TestBytes(t *testing.T) {
+	d, keys := sortedTestDict(3000)
+	b := Dict{}
+	n := Dict{}
+	buf := make([]byte, 0, 8)
+	for _, k := range keys {
+		v, _ := d.ValueAt(k)
+		buf = append(buf[:0], k...)
+		b = b.AssocBytes(buf, v)
+		n = n.AssocNoCopy(k, v)
+		// The dict mustn't hold on to the caller's slice.
+		for i := range buf { buf[i] = 'X' }
+	}
+	for _, r := range []Dict{b, n} {
+		if r.Count() != d.Count() { t.Errorf("expected %d entries, got %d", d.Count(), r.Count()) }
+		r.Foreach(func(key string, val Value) {
+			if v, ok := d.ValueAt(key); !ok || v != val { t.Errorf("unexpected %q = %v", key, val) }
+		})
+	}
+	for i := 0; i < 1000; i++ {
+		k := []byte(keys[rand.Intn(len(keys))])
+		if rand.Intn(2) == 0 { k = append(k, byte(rand.Intn(256))) }
+		v, ok := d.ValueAt(string(k))
+		if w, found := b.ValueAtBytes(k); found != ok || w != v { t.Errorf("ValueAtBytes(%q): got %v", k, w) }
+		if b.ContainsBytes(k) != ok { t.Errorf("ContainsBytes(%q): expected %v", k, ok) }
+	}
+	// Replacing a value keeps the key the node already has, rather than a copy of the caller's.
+	r := Dict{}.Assoc("key", 1).Assoc("key/a", 2).Assoc("key/b", 3)
+	for _, s := range []Dict{r.AssocBytes([]byte("key"), 4), r.AssocNoCopy("key", 4), r.Assoc("key", 4)} {
+		if v, _ := s.ValueAt("key"); v.(int) != 4 || !sameBytes(s.t.key(), r.t.key()) {
+			t.Errorf("Replacing the value at \"key\" copied the key")
+		}
+	}
+}
+
+func TestIntDict(t *testing.T) {
+	var d IntDict
+	var keys []uint64
+	for _, base := range []uint64{0, 1 << 20, 1 << 40, 1<<64 - 1000} {
+		for i := uint64(0); i < 1000; i += uint64(1 + rand.Intn(3)) {
+			d = d.Assoc(base + i, base + i)
+			keys = append(keys, base + i)
+		}
+	}
+	if d.Count() != len(keys) { t.Errorf("IntDict: expected %d entries, got %d", len(keys), d.Count()) }
+	i := 0
+	d.Foreach(func(key uint64, val Value) {
+		if i >= len(keys) || key != keys[i] || val.(uint64) != key { t.Errorf("IntDict: entry %d out of order", i) }
+		i++
+	})
+	n := 0
+	d.Range(1<<20 + 10, 1<<20 + 99, func(key uint64, val Value) {
+		if key < 1<<20 + 10 || key > 1<<20 + 99 { t.Errorf("Range: %d out of bounds", key) }
+		n++
+	})
+	ex := 0
+	for _, k := range keys {
+		if k >= 1<<20 + 10 && k <= 1<<20 + 99 { ex++ }
+	}
+	if n != ex { t.Errorf("Range: expected %d entries, got %d", ex, n) }
+	n, ex = 0, 0
+	d.Range(1<<64 - 10, 1<<64 - 1, func(uint64, Value) { n++ })
+	for _, k := range keys {
+		if k >= 1<<64 - 10 { ex++ }
+	}
+	if n != ex { t.Errorf("Range to the largest key: expected %d entries, got %d", ex, n) }
+	if k, _, ok := d.Ceiling(1000); !ok || k != 1<<20 { t.Errorf("Ceiling(1000): got %d", k) }
+	if k, _, ok := d.Floor(1<<40 - 1); !ok || k != keys[sort.Search(len(keys), func(i int) bool { return keys[i] >= 1<<40 }) - 1] {
+		t.Errorf("Floor(1<<40 - 1): got %d", k)
+	}
+	if k, _, _ := d.Min(); k != 0 { t.Errorf("Min: got %d", k) }
+	if v, ok := d.ValueAt(keys[7]); !ok || v.(uint64) != keys[7] { t.Errorf("ValueAt(%d): got %v", keys[7], v) }
+	if d.Without(keys[7]).Contains(keys[7]) { t.Errorf("Without(%d) didn't remove it", keys[7]) }
+
+	// A run of consecutive IDs fills a single span.
+	var c IntDict
+	for i := uint64(0); i < 256; i++ { c = c.Assoc(1<<32 + i, i) }
+	if _, ok := c.d.t.(*spanK); !ok { t.Errorf("consecutive IDs should make a span, got %T", c.d.t) }
+
+	var s Int64Dict
+	for _, k := range []int64{5, -1, 0, -1 << 63, 1<<63 - 1, -300, 300} { s = s.Assoc(k, k) }
+	var got []int64
+	s.Foreach(func(key int64, val Value) { got = append(got, key) })
+	if !reflect.DeepEqual(got, []int64{-1 << 63, -300, -1, 0, 5, 300, 1<<63 - 1}) { t.Errorf("Int64Dict: wrong order %v", got) }
+	got = nil
+	s.Range(-300, 5, func(key int64, val Value) { got = append(got, key) })
+	if !reflect.DeepEqual(got, []int64{-300, -1, 0, 5}) { t.Errorf("Int64Dict.Range: got %v", got) }
+	if k, _, ok := s.Lower(0); !ok || k != -1 { t.Errorf("Int64Dict.Lower(0): got %d", k) }
+	if k, _, ok := s.Higher(300); !ok || k != 1<<63 - 1 { t.Errorf("Int64Dict.Higher(300): got %d", k) }
+}
+
+func TestSet(t *testing.T) {
+	_, keys := sortedTestDict(3000)
+	var base Set
+	for _, k := range keys { base = base.Add(k) }
+	derive := func() (Set, map[string]bool) {
+		s := base
+		for i := 0; i < 300; i++ {
+			k := make([]byte, rand.Intn(5))
+			for j := range k { k[j] = byte('a' + rand.Intn(4)) }
+			if rand.Intn(3) == 0 { s = s.Remove(string(k)) } else { s = s.Add(string(k)) }
+		}
+		m := make(map[string]bool)
+		s.Foreach(func(key string) { m[key] = true })
+		return s, m
+	}
+	a, am := derive()
+	b, bm := derive()
+	check := func(op string, s Set, ex map[string]bool) {
+		if s.Count() != len(ex) { t.Errorf("%s: expected %d keys, got %d", op, len(ex), s.Count()) }
+		last := ""
+		s.Foreach(func(key string) {
+			if !ex[key] { t.Errorf("%s: unexpected %q", op, key) }
+			if key < last { t.Errorf("%s: %q came after %q", op, key, last) }
+			last = key
+		})
+		for key := range ex {
+			if !s.Contains(key) { t.Errorf("%s: missing %q", op, key) }
+		}
+	}
+	check("Add", a, am)
+
+	ex := make(map[string]bool)
+	for k := range am { ex[k] = true }
+	for k := range bm { ex[k] = true }
+	check("Union", a.Union(b), ex)
+	ex = make(map[string]bool)
+	for k := range am {
+		if bm[k] { ex[k] = true }
+	}
+	check("Intersect", a.Intersect(b), ex)
+	ex = make(map[string]bool)
+	for k := range am {
+		if !bm[k] { ex[k] = true }
+	}
+	check("Difference", a.Difference(b), ex)
+
+	if !a.Intersect(b).IsSubset(a) || !a.IsSubset(a.Union(b)) || !(Set{}).IsSubset(a) {
+		t.Errorf("IsSubset should hold")
+	}
+	if b.IsSubset(a) != (b.Difference(a).Count() == 0) { t.Errorf("IsSubset disagrees with Difference") }
+	var last string
+	a.Foreach(func(key string) { last = key })
+	if a.Add("zzz").IsSubset(a) || a.IsSubset(a.Remove(last).Add("zzz")) { t.Errorf("IsSubset shouldn't hold") }
+	if a.Union(a).t != a.t { t.Errorf("Union with itself should return the same trie") }
+	if a.Add(last).t != a.t { t.Errorf("Adding a key that is there should change nothing") }
+
+	// No node of a Set holds a value.
+	stats := GetStats(Dict{a.t})
+	for _, k := range []int{kLeafV, kLeafKV, kBagV, kBagKV, kSpanV, kSpanKV, kBitmapV, kBitmapKV} {
+		if stats[k] != 0 { t.Errorf("a Set shouldn't have nodes of variant %d", k) }
+	}
+}
+
+func TestSetOverValues(t *testing.T) {
+	// Adding a Set's member to a node with a value makes a member node, and a value added to a
+	// member node makes a node with a value, for a bag, a span and a bitmap, with and without
+	// a key of their own.
+	for _, shape := range [][2]int{{20, 3}, {1, 10}, {9, 10}} {
+		step, n := shape[0], shape[1]
+		for _, prefix := range []string{"", "k"} {
+			d := Dict{}.Assoc(prefix, multiplicity(3))
+			for i := 0; i < n; i++ {
+				d = d.Assoc(prefix + string([]byte{byte('!' + step*i)}), multiplicity(i))
+			}
+			sum := n*(n-1)/2
+			s := Set{d.t}.Add(prefix)
+			switch s.t.(type) {
+			case *bagM, *bagKM, *spanM, *spanKM, *bitmapM, *bitmapKM:
+			default: t.Errorf("%d %q: expected a member node, got %T", step, prefix, s.t)
+			}
+			if s.Count() != n+1 || !s.Contains(prefix) { t.Errorf("%d %q: lost a key", step, prefix) }
+			if checkSums("Set.Add", s.t, t) != sum { t.Errorf("%d %q: expected a sum of %d", step, prefix, sum) }
+
+			d = Dict{s.t}.Assoc(prefix, multiplicity(2))
+			if v, ok := d.ValueAt(prefix); !ok || v != multiplicity(2) {
+				t.Errorf("%d %q: expected 2, got %v", step, prefix, v)
+			}
+			if d.Count() != n+1 || checkSums("Assoc", d.t, t) != sum+2 {
+				t.Errorf("%d %q: wrong count or sum", step, prefix)
+			}
+		}
+	}
+}
+
+// Checks that the sum kept in each node of t is the sum of the weights of its values.
+func checkSums(op string, t itrie, tt *testing.T) int {
+	sum := 0
+	if t.hasVal() { sum = weight(t.val()) }
+	t.withsubs(0, 256, func(cb byte, sub itrie) { sum += checkSums(op, sub, tt) })
+	if t.sum() != sum { tt.Errorf("%s: %T %q has sum %d, expected %d", op, t, t.key(), t.sum(), sum) }
+	return sum
+}
+
+func TestMultiSet(t *testing.T) {
+	var a, b MultiSet
+	am, bm := make(map[string]int), make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		k := string([]byte{byte('a' + rand.Intn(8)), byte('a' + rand.Intn(8))})
+		n := rand.Intn(5) + 1
+		switch rand.Intn(4) {
+		case 0:
+			a = a.Remove(k, n)
+			if am[k] -= n; am[k] <= 0 { am[k] = 0, false }
+		case 1:
+			b = b.Add(k, n); bm[k] += n
+		default:
+			a = a.Add(k, n); am[k] += n
+		}
+	}
+	check := func(op string, m MultiSet, ex map[string]int) {
+		total := 0
+		for k, n := range ex {
+			total += n
+			if m.Count(k) != n { t.Errorf("%s: count of %q is %d, expected %d", op, k, m.Count(k), n) }
+		}
+		if m.Total() != total { t.Errorf("%s: total is %d, expected %d", op, m.Total(), total) }
+		if m.Distinct() != len(ex) { t.Errorf("%s: %d keys, expected %d", op, m.Distinct(), len(ex)) }
+		if m.d.t != nil { checkSums(op, m.d.t, t) }
+	}
+	check("Add", a, am)
+	check("Add", b, bm)
+
+	for _, p := range []string{"", "c", "cd", "cdx"} {
+		ex := make(map[string]int)
+		for k, n := range am {
+			if len(k) >= len(p) && k[:len(p)] == p { ex[k] = n }
+		}
+		check("WithPrefix " + p, a.WithPrefix(p), ex)
+		if a.TotalPrefix(p) != a.WithPrefix(p).Total() {
+			t.Errorf("TotalPrefix(%q) is %d, expected %d", p, a.TotalPrefix(p), a.WithPrefix(p).Total())
+		}
+	}
+	ex := make(map[string]int)
+	for k, n := range am {
+		if k >= "bd" && k < "fa" { ex[k] = n }
+	}
+	check("Slice", a.Slice("bd", "fa"), ex)
+
+	// Keys on interior nodes, changed in place by a Transient.
+	var c MultiSet
+	tr := c.d.Transient()
+	cm := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		k := "abcdefgh"[:rand.Intn(8)] + string([]byte{byte('a' + rand.Intn(20))})
+		n := rand.Intn(5) + 1
+		if rand.Intn(5) == 0 {
+			tr.Without(k); cm[k] = 0, false
+		} else {
+			tr.Assoc(k, multiplicity(n)); cm[k] = n
+		}
+	}
+	check("Transient", MultiSet{tr.Persistent()}, cm)
+
+	ex = make(map[string]int)
+	for k, n := range am { ex[k] += n }
+	for k, n := range bm { ex[k] += n }
+	check("Sum", a.Sum(b), ex)
+	ex = make(map[string]int)
+	for k, n := range am {
+		if n > bm[k] { ex[k] = n - bm[k] }
+	}
+	check("Difference", a.Difference(b), ex)
+	if a.Remove("zz", 1).Total() != a.Total() { t.Errorf("removing a missing key changed the total") }
+
+	keys := make([]string, 0, len(am))
+	for k := range am { keys = append(keys, k) }
+	sort.Strings(keys)
+	var got []string
+	a.Top(10, func(key string, n int) {
+		if n != am[key] { t.Errorf("Top: %q has count %d, not %d", key, am[key], n) }
+		got = append(got, key)
+	})
+	if len(got) != 10 { t.Fatalf("Top(10) gave %d keys", len(got)) }
+	for i := 1; i < len(got); i++ {
+		if am[got[i]] > am[got[i-1]] || (am[got[i]] == am[got[i-1]] && got[i] < got[i-1]) {
+			t.Errorf("Top out of order at %d: %q, %q", i, got[i-1], got[i])
+		}
+	}
+	// Nothing left out ranks above the last key given.
+	last := got[len(got)-1]
+	for _, k := range keys {
+		in := false
+		for _, g := range got { in = in || g == k }
+		if !in && (am[k] > am[last] || (am[k] == am[last] && k < last)) { t.Errorf("Top left out %q", k) }
+	}
+}
+
+func TestMultiDict(t *testing.T) {
+	var m MultiDict
+	ex := make(map[string]map[Value]bool)
+	for i := 0; i < 5000; i++ {
+		k := string([]byte{byte('a' + rand.Intn(6))})
+		// Values of different types are different values.
+		var v Value = rand.Intn(300)
+		if rand.Intn(2) == 0 { v = fmt.Sprint(v) }
+		if ex[k] == nil { ex[k] = make(map[Value]bool) }
+		switch rand.Intn(20) {
+		case 0:
+			m = m.RemoveAll(k); ex[k] = nil, false
+		case 1, 2, 3, 4:
+			m = m.Remove(k, v); ex[k][v] = false, false
+			if len(ex[k]) == 0 { ex[k] = nil, false }
+		default:
+			m = m.Put(k, v); ex[k][v] = true
+		}
+	}
+	total := 0
+	for k, vals := range ex {
+		total += len(vals)
+		if m.CountValues(k) != len(vals) { t.Errorf("%q has %d values, expected %d", k, m.CountValues(k), len(vals)) }
+		n := 0
+		m.Values(k, func(v Value) {
+			if !vals[v] { t.Errorf("unexpected value %v for %q", v, k) }
+			n++
+		})
+		if n != len(vals) { t.Errorf("Values gave %d values for %q, expected %d", n, k, len(vals)) }
+	}
+	if m.Count() != total || m.CountKeys() != len(ex) {
+		t.Errorf("expected %d pairs under %d keys, got %d under %d", total, len(ex), m.Count(), m.CountKeys())
+	}
+	n := 0
+	m.Foreach(func(k string, v Value) {
+		if !ex[k][v] { t.Errorf("unexpected pair %q, %v", k, v) }
+		n++
+	})
+	if n != total { t.Errorf("Foreach gave %d pairs, expected %d", n, total) }
+
+	// Putting a pair that is there, or removing one that isn't, changes nothing.
+	var k string
+	var v Value
+	m.Foreach(func(key string, val Value) { k, v = key, val })
+	if m.Put(k, v).d.t != m.d.t || m.Remove(k, "none").d.t != m.d.t || m.Remove("none", v).d.t != m.d.t {
+		t.Errorf("a change that changes nothing should return the same trie")
+	}
+	// Earlier versions are untouched by later changes.
+	r := m.Remove(k, v)
+	if !m.Contains(k, v) || r.Contains(k, v) || r.Count() != m.Count()-1 { t.Errorf("Remove wasn't persistent") }
+}
+
+// A key with few enough hashes that many keys collide.
+type badHash int
+
+func (k badHash) Hash() uint64 { return uint64(k % 7) << 56 | uint64(k % 5) }
+func (k badHash) Equal(other Value) bool {
+	o, ok := other.(badHash)
+	return ok && o == k
+}
+
+// A Hashable key that == can't compare.
+type wordsKey struct {
+	words []string
+}
+
+func (k wordsKey) Hash() uint64 { return hashString(strings.Join(k.words, " ")) }
+func (k wordsKey) Equal(other Value) bool {
+	o, ok := other.(wordsKey)
+	return ok && strings.Join(o.words, " ") == strings.Join(k.words, " ")
+}
+
+type point struct {
+	x, y float64
+}
+
+func TestHashDict(t *testing.T) {
+	var d HashDict
+	ex := make(map[Value]int)
+	var versions []HashDict
+	var models []map[Value]int
+	for i := 0; i < 20000; i++ {
+		var k Value
+		switch rand.Intn(3) {
+		case 0: k = rand.Intn(3000)
+		case 1: k = fmt.Sprint(rand.Intn(3000))
+		default: k = badHash(rand.Intn(100))
+		}
+		if rand.Intn(3) == 0 {
+			d = d.Without(k); ex[k] = 0, false
+		} else {
+			d = d.Assoc(k, i); ex[k] = i
+		}
+		if i % 5000 == 0 {
+			m := make(map[Value]int)
+			for k, v := range ex { m[k] = v }
+			versions = append(versions, d); models = append(models, m)
+		}
+	}
+	versions = append(versions, d); models = append(models, ex)
+	for j, d := range versions {
+		ex := models[j]
+		if d.Count() != len(ex) { t.Fatalf("expected %d entries, got %d", len(ex), d.Count()) }
+		for k, v := range ex {
+			if val, ok := d.ValueAt(k); !ok || val.(int) != v { t.Fatalf("%v is %v, expected %d", k, val, v) }
+		}
+		n := 0
+		d.Foreach(func(k, v Value) {
+			if ex[k] != v.(int) { t.Errorf("unexpected entry %v: %v", k, v) }
+			n++
+		})
+		if n != len(ex) { t.Errorf("Foreach gave %d entries, expected %d", n, len(ex)) }
+	}
+	// Different types are different keys, even when they look alike.
+	e := HashDict{}.Assoc(1, "a").Assoc("7", "b")
+	if e.Contains(int64(1)) || e.Contains(7) || !e.Contains("7") { t.Errorf("keys of different types match") }
+	if d.Assoc(badHash(3), "x").Without(badHash(10)).Contains(badHash(10)) { t.Errorf("collision not removed") }
+
+	// Iter and a HashCursor, in either direction, visit the entries in Foreach's order.
+	var keys []Value
+	d.Foreach(func(k, v Value) { keys = append(keys, k) })
+	n := 0
+	for item := range d.Iter() {
+		if n >= len(keys) || !keysEqual(item.key, keys[n]) || item.val.(int) != ex[item.key] {
+			t.Fatalf("Iter gave %v: %v at %d", item.key, item.val, n)
+		}
+		n++
+	}
+	if n != len(keys) { t.Errorf("Iter gave %d entries, expected %d", n, len(keys)) }
+	c := d.Cursor()
+	n = 0
+	for c.Next() {
+		if !keysEqual(c.Key(), keys[n]) || c.Value().(int) != ex[c.Key()] { t.Fatalf("Next gave %v at %d", c.Key(), n) }
+		n++
+	}
+	if n != len(keys) || c.Valid() { t.Errorf("Next gave %d entries, expected %d", n, len(keys)) }
+	for c.Prev() {
+		n--
+		if !keysEqual(c.Key(), keys[n]) { t.Fatalf("Prev gave %v at %d", c.Key(), n) }
+	}
+	if n != 0 { t.Errorf("Prev stopped at %d", n) }
+	if (HashDict{}).Cursor().First() { t.Errorf("First on an empty HashDict") }
+
+	// Update and the Report variants find the key once, and leave d alone when nothing changes.
+	k := keys[0]
+	u := d.Update(k, func(old Value, present bool) (Value, bool) { return old, present })
+	if u.t != d.t { t.Errorf("Update that changes nothing should return d itself") }
+	u, old, replaced := d.AssocReport(k, -1)
+	if !replaced || old.(int) != ex[k] { t.Errorf("AssocReport gave %v, %v", old, replaced) }
+	if v, _ := u.ValueAt(k); v.(int) != -1 || u.Count() != d.Count() { t.Errorf("AssocReport didn't replace %v", k) }
+	u, old, removed := d.WithoutReport(k)
+	if !removed || old.(int) != ex[k] || u.Contains(k) || u.Count() != d.Count()-1 { t.Errorf("WithoutReport didn't remove %v", k) }
+	u, _, removed = u.WithoutReport(k)
+	if removed { t.Errorf("WithoutReport removed %v twice", k) }
+	u, _, replaced = u.AssocReport(k, 1)
+	if replaced || !u.Contains(k) || u.Count() != d.Count() { t.Errorf("AssocReport didn't add %v", k) }
+
+	for k := range ex { d = d.Without(k) }
+	if d.Count() != 0 || d.t != nil { t.Errorf("removing every key should leave an empty HashDict") }
+
+	// Keys of the basic types, as == compares them.
+	negZero := math.Copysign(0, -1)
+	e = HashDict{}.Assoc("a", 1).Assoc(negZero, 2).Assoc(true, 3).Assoc(int8(-4), 4).
+		Assoc(uintptr(5), 5).Assoc(float32(1.5), 7).Assoc(uint16(7), 8).Assoc(complex(1, 2), 9)
+	same := []Value{"a", 0.0, true, int8(-4), uintptr(5), float32(1.5), uint16(7), complex(1, 2)}
+	for _, k := range same {
+		if !e.Contains(k) { t.Errorf("%v should be a key", k) }
+	}
+	if v, _ := e.ValueAt(0.0); v != 2 { t.Errorf("0 and -0 should be the same key, got %v", v) }
+	for _, k := range []Value{"b", false, int16(-4), uint(5), 1.5, int(7), complex64(complex(1, 2))} {
+		if e.Contains(k) { t.Errorf("%v shouldn't be a key", k) }
+	}
+	// Hashable keys are compared with Equal, so they needn't be comparable.
+	w := HashDict{}.Assoc(wordsKey{[]string{"a", "b"}}, 1).Assoc(wordsKey{[]string{"c"}}, 2)
+	if v, _ := w.ValueAt(wordsKey{[]string{"a", "b"}}); v != 1 || w.Count() != 2 { t.Errorf("wordsKey lookup gave %v", v) }
+	if w.Without(wordsKey{[]string{"c"}}).Contains(wordsKey{[]string{"c"}}) { t.Errorf("wordsKey not removed") }
+	// Other keys panic, whether or not == could compare them.
+	for _, k := range []Value{[]int{1}, new(int), point{1, 2}, [2]int8{1, 2}} {
+		func() {
+			defer func() {
+				if recover() == nil { t.Errorf("a %T key should panic", k) }
+			}()
+			HashDict{}.Assoc(k, 1)
+		}()
+	}
+}
+
+func TestAtom(t *testing.T) {
+	const workers = 8
+	const perWorker = 500
+	var a Atom
+	if a.Deref().Count() != 0 { t.Errorf("the zero Atom should hold an empty Dict") }
+	a.AddValidator(func(d Dict) bool {
+		n, _ := d.ValueAt("n")
+		return n == nil || n.(int) >= 0
+	})
+	watched := make(chan int, workers*perWorker)
+	a.AddWatch("w", func(old, d Dict) {
+		n, _ := d.ValueAt("n")
+		o, ok := old.ValueAt("n")
+		if !ok { o = 0 }
+		if n.(int) != o.(int) + 1 { t.Errorf("watch saw %v after %v", n, o) }
+		watched <- n.(int)
+	})
+
+	incr := func(d Dict) Dict {
+		n, ok := d.ValueAt("n")
+		if !ok { n = 0 }
+		return d.Assoc("n", n.(int) + 1)
+	}
+	done := make(chan bool)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := 0; i < perWorker; i++ { a.Swap(incr) }
+			done <- true
+		}()
+	}
+	for w := 0; w < workers; w++ { <-done }
+	if n, _ := a.Deref().ValueAt("n"); n.(int) != workers*perWorker {
+		t.Errorf("expected n == %d after concurrent Swaps, got %v", workers*perWorker, n)
+	}
+	seen := make(map[int]bool)
+	for i := 0; i < workers*perWorker; i++ { seen[<-watched] = true }
+	if len(seen) != workers*perWorker { t.Errorf("watches saw %d distinct versions", len(seen)) }
+
+	a.RemoveWatch("w")
+	cur := a.Deref()
+	if d, err := a.Swap(func(d Dict) Dict { return d.Assoc("n", -1) }); err != ErrInvalid || d.t != cur.t {
+		t.Errorf("a validator should have rejected the Swap")
+	}
+	if a.Reset(cur.Assoc("n", -1)) != ErrInvalid { t.Errorf("a validator should have rejected the Reset") }
+	next := cur.Assoc("m", 1)
+	if ok, _ := a.CompareAndSet(next, cur); ok { t.Errorf("CompareAndSet from a version that isn't current") }
+	if ok, err := a.CompareAndSet(cur, next); !ok || err != nil || a.Deref().t != next.t {
+		t.Errorf("CompareAndSet from the current version should succeed")
+	}
+	if a.Reset(Dict{}) != nil || a.Deref().Count() != 0 { t.Errorf("Reset should replace the version") }
+}
+
 func randomKey() string {
 	r := rand.Int63n(1000000000) + 10000000000
 	return fmt.Sprintf("%x", r)
@@ -577,6 +2035,9 @@ func TestRandomAssocStats(t *testing.T) {
 		values[i] = i
 	}
 	ResetCumulativeStats()
+	for i, n := range Cumulative {
+		if n != 0 { t.Errorf("Expected variant %d to count 0 after a reset, got %d", i, n) }
+	}
 	runtime.GC()
 	snapshotGC()
 
@@ -630,3 +2091,41 @@ func BenchmarkAssoc(b *testing.B) {
 		d = d.Assoc(key, values[i])
 	}
 }
+func BenchmarkTransientAssoc(b *testing.B) {
+	b.StopTimer()
+	keys := make([]string, b.N)
+	values :=  make([]Value, b.N)
+	for i, _ := range keys {
+		keys[i] = randomKey()
+		values[i] = i
+	}
+	runtime.GC()
+	b.StartTimer()
+	tr := Dict{}.Transient()
+	for i, key := range keys {
+		tr.Assoc(key, values[i])
+	}
+	tr.Persistent()
+}
+func BenchmarkFromSorted(b *testing.B) {
+	b.StopTimer()
+	keys := make([]string, b.N)
+	for i, _ := range keys {
+		keys[i] = randomKey()
+	}
+	sort.Strings(keys)
+	// randomKey can repeat itself, and FromSorted would refuse the duplicates.
+	n := 0
+	for _, key := range keys {
+		if n == 0 || key != keys[n-1] { keys[n] = key; n++ }
+	}
+	keys = keys[:n]
+	runtime.GC()
+	b.StartTimer()
+	i := 0
+	FromSorted(func() (string, Value, bool) {
+		if i == len(keys) { return "", nil, false }
+		i++
+		return keys[i-1], i, true
+	})
+}
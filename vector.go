@@ -0,0 +1,239 @@
+package immutable
+
+import "fmt"
+import "unsafe"
+import "runtime"
+
+/*
+ Vector
+
+ A Vector is an immutable sequence of values indexed from 0, after Clojure's vector.  The
+ values are held in the leaves of a trie in which each node has up to 32 slots, indexed by 5
+ bits of the index at a time, except for the last 1 to 32 values, which are held in a tail
+ node of their own so that Conj and Pop seldom have to touch the trie.  Like a Dict, a
+ Vector is never changed: Conj, Pop and AssocN copy only the nodes on one path and share the
+ rest with the Vector they started from.
+
+ A Vector is a view of a run of the values in a trie, which are all of them unless the Vector
+ came from Slice.  Slice takes constant time, since the slice shares the whole trie, but that
+ also keeps every value in the trie alive for as long as the slice is, as for Clojure's subvec.
+*/
+type Vector struct {
+	t vtrie
+	start int	// the index in t of the Vector's first value
+	count int
+}
+
+// The trie of a Vector.
+type vtrie struct {
+	count int
+	shift uint	// the index bits above those taken by the root; 0 when there is no root
+	root *vnode	// the full leaves, or nil if there are none
+	tail *vnode
+}
+
+const vshift = 5
+const vwidth = 1 << vshift
+const vmask = vwidth - 1
+
+/*
+ A node of a Vector's trie.  The slots of a leaf hold values, and those of any other node
+ hold the *vnodes beneath it.  Nodes are filled from the left, and like bags, are allocated
+ with only as many slots as they use.
+*/
+type vnode struct {
+	occupied_ uint8
+	slot [vwidth]Value
+}
+
+var sizeofVnode uintptr
+
+func init() {
+	var n vnode
+	sizeofVnode = uintptr(unsafe.Sizeof(n)) - vwidth*uintptr(unsafe.Sizeof(n.slot[0]))
+}
+
+func newVnode(size int) *vnode {
+	asize := uintptr(unsafe.Sizeof(Value(nil)))*uintptr(size)+sizeofVnode
+	n := (*vnode)(unsafe.Pointer(runtime.Alloc(asize)))
+	n.occupied_ = uint8(size)
+	return n
+}
+func nodeOf(slots []Value) *vnode {
+	n := newVnode(len(slots))
+	copy(n.slot[:], slots)
+	return n
+}
+// n with size slots, the first of which are n's own.  n may be nil.
+func resized(n *vnode, size int) *vnode {
+	r := newVnode(size)
+	if n != nil { copy(r.slot[:size], n.slot[:n.occupied_]) }
+	return r
+}
+// n with x in slot i, which may be the slot after its last.  n may be nil.
+func setSlot(n *vnode, i int, x Value) *vnode {
+	size := 0
+	if n != nil { size = int(n.occupied_) }
+	if i == size { size++ }
+	r := resized(n, size)
+	r.slot[i] = x
+	return r
+}
+// A path of nodes from level down to the leaf l.
+func newPath(level uint, l *vnode) *vnode {
+	if level == 0 { return l }
+	return nodeOf([]Value{newPath(level-vshift, l)})
+}
+// The index of the first value in the tail.
+func (v vtrie) tailOffset() int {
+	if v.count == 0 { return 0 }
+	return (v.count-1) &^ vmask
+}
+// The leaf holding the value at index i.
+func (v vtrie) leafFor(i int) *vnode {
+	if i >= v.tailOffset() { return v.tail }
+	n := v.root
+	for level := v.shift; level > 0; level -= vshift {
+		n = n.slot[(i >> level) & vmask].(*vnode)
+	}
+	return n
+}
+func (v vtrie) pushTail(level uint, parent *vnode) *vnode {
+	i := ((v.count-1) >> level) & vmask
+	var x Value = v.tail
+	if level > vshift {
+		if i < int(parent.occupied_) {
+			x = v.pushTail(level-vshift, parent.slot[i].(*vnode))
+		} else {
+			x = newPath(level-vshift, v.tail)
+		}
+	}
+	return setSlot(parent, i, x)
+}
+func (v vtrie) popTail(level uint, n *vnode) *vnode {
+	i := ((v.count-2) >> level) & vmask
+	if level > vshift {
+		sub := v.popTail(level-vshift, n.slot[i].(*vnode))
+		if sub != nil { return setSlot(n, i, sub) }
+	}
+	if i == 0 { return nil }
+	return resized(n, i)
+}
+func assocN(level uint, n *vnode, i int, val Value) *vnode {
+	j := (i >> level) & vmask
+	if level == 0 { return setSlot(n, j, val) }
+	return setSlot(n, j, assocN(level-vshift, n.slot[j].(*vnode), i, val))
+}
+
+// v with val added at the end.
+func (v vtrie) conj(val Value) vtrie {
+	if v.count - v.tailOffset() < vwidth {
+		r := v
+		r.count++
+		r.tail = setSlot(v.tail, v.count - v.tailOffset(), val)
+		return r
+	}
+	// The tail is full, so it moves into the trie and val starts a new one.
+	r := vtrie{count: v.count+1, shift: v.shift, tail: nodeOf([]Value{val})}
+	switch {
+	case v.root == nil:
+		r.root, r.shift = nodeOf([]Value{v.tail}), vshift
+	case v.count >> vshift > 1 << v.shift:
+		// The trie is full, so it gets a new root with the old one on its left.
+		r.root, r.shift = nodeOf([]Value{v.root, newPath(v.shift, v.tail)}), v.shift+vshift
+	default:
+		r.root = v.pushTail(v.shift, v.root)
+	}
+	return r
+}
+// v without its last value.  v mustn't be empty.
+func (v vtrie) pop() vtrie {
+	switch {
+	case v.count == 1:
+		return vtrie{}
+	case v.count - v.tailOffset() > 1:
+		r := v
+		r.count--
+		r.tail = resized(v.tail, int(v.tail.occupied_)-1)
+		return r
+	}
+	// The tail empties, so the last leaf comes out of the trie to take its place.
+	r := vtrie{count: v.count-1, shift: v.shift, tail: v.leafFor(v.count-2)}
+	r.root = v.popTail(v.shift, v.root)
+	switch {
+	case r.root == nil:
+		r.shift = 0
+	case r.shift > vshift && r.root.occupied_ == 1:
+		r.root, r.shift = r.root.slot[0].(*vnode), r.shift-vshift
+	}
+	return r
+}
+// v with val at index i, which must be in range.
+func (v vtrie) assoc(i int, val Value) vtrie {
+	r := v
+	if i >= v.tailOffset() {
+		r.tail = setSlot(v.tail, i & vmask, val)
+	} else {
+		r.root = assocN(v.shift, v.root, i, val)
+	}
+	return r
+}
+// Calls fn with each index from start up to end, and its value.
+func (v vtrie) foreachIn(start, end int, fn func(int, Value)) {
+	for i := start; i < end; {
+		l := v.leafFor(i)
+		for j := i & vmask; j < int(l.occupied_) && i < end; j++ {
+			fn(i, l.slot[j])
+			i++
+		}
+	}
+}
+
+func (v Vector) check(i int) {
+	if i < 0 || i >= v.count {
+		panic(fmt.Sprintf("Vector index %d out of range for count %d", i, v.count))
+	}
+}
+func (v Vector) Count() int { return v.count }
+// Returns the Vector with val added at the end.
+func (v Vector) Conj(val Value) Vector {
+	// A slice that ends before its trie does takes over the trie's next value.
+	if end := v.start + v.count; end < v.t.count { return Vector{v.t.assoc(end, val), v.start, v.count+1} }
+	return Vector{v.t.conj(val), v.start, v.count+1}
+}
+// Returns the Vector without its last value.
+func (v Vector) Pop() Vector {
+	switch {
+	case v.count == 0:
+		panic("can't Pop an empty Vector.")
+	case v.count == 1:
+		return Vector{}
+	case v.start + v.count < v.t.count:
+		return Vector{v.t, v.start, v.count-1}
+	}
+	return Vector{v.t.pop(), v.start, v.count-1}
+}
+// The value at index i, which must be in range.
+func (v Vector) Nth(i int) Value {
+	v.check(i)
+	i += v.start
+	return v.t.leafFor(i).slot[i & vmask]
+}
+// Returns the Vector with val at index i.  i may be Count(), to add val at the end.
+func (v Vector) AssocN(i int, val Value) Vector {
+	if i == v.count { return v.Conj(val) }
+	v.check(i)
+	return Vector{v.t.assoc(v.start + i, val), v.start, v.count}
+}
+// Calls fn with each index and its value, in order.
+func (v Vector) Foreach(fn func(i int, val Value)) {
+	v.t.foreachIn(v.start, v.start + v.count, func(i int, val Value) { fn(i - v.start, val) })
+}
+// Returns the Vector of the values from index start up to end, which shares v's whole trie.
+func (v Vector) Slice(start, end int) Vector {
+	if start < 0 || end > v.count || start > end {
+		panic(fmt.Sprintf("Vector slice [%d:%d] out of range for count %d", start, end, v.count))
+	}
+	if start == end { return Vector{} }
+	return Vector{v.t, v.start + start, end - start}
+}
@@ -0,0 +1,123 @@
+package immutable
+
+import (
+	"testing"
+	"rand"
+	"runtime"
+)
+
+func checkVector(t *testing.T, op string, v Vector, ex []int) {
+	if v.Count() != len(ex) { t.Fatalf("%s: count is %d, expected %d", op, v.Count(), len(ex)) }
+	for i, x := range ex {
+		if v.Nth(i).(int) != x { t.Fatalf("%s: value at %d is %v, expected %d", op, i, v.Nth(i), x) }
+	}
+	n := 0
+	v.Foreach(func(i int, val Value) {
+		if i != n || val.(int) != ex[i] { t.Fatalf("%s: Foreach gave %d: %v at step %d", op, i, val, n) }
+		n++
+	})
+	if n != len(ex) { t.Fatalf("%s: Foreach gave %d values, expected %d", op, n, len(ex)) }
+}
+
+func TestVectorConjPop(t *testing.T) {
+	// Far enough to need a trie three levels deep, and back down again.
+	const n = 40000
+	var v Vector
+	versions := make([]Vector, n+1)
+	versions[0] = v
+	for i := 0; i < n; i++ {
+		v = v.Conj(i)
+		versions[i+1] = v
+	}
+	ex := make([]int, n)
+	for i := range ex { ex[i] = i }
+	checkVector(t, "Conj", v, ex)
+	for i := n; i > 0; i-- {
+		if i % 997 == 0 || i < 70 || (i > 1000 && i < 1100) { checkVector(t, "Pop", v, ex[:i]) }
+		v = v.Pop()
+	}
+	if v.Count() != 0 { t.Errorf("Popping everything left %d values", v.Count()) }
+	// The earlier versions are untouched.
+	for _, i := range []int{0, 1, 32, 33, 1056, 1057, n} { checkVector(t, "versions", versions[i], ex[:i]) }
+}
+
+func TestVectorAssocN(t *testing.T) {
+	var v Vector
+	var ex []int
+	for i := 0; i < 3000; i++ {
+		v = v.AssocN(v.Count(), i)
+		ex = append(ex, i)
+	}
+	old := v
+	for i := 0; i < 2000; i++ {
+		j, x := rand.Intn(len(ex)), rand.Int()
+		v = v.AssocN(j, x)
+		ex[j] = x
+	}
+	checkVector(t, "AssocN", v, ex)
+	for i := 0; i < old.Count(); i++ {
+		if old.Nth(i).(int) != i { t.Fatalf("AssocN changed the Vector it started from at %d", i) }
+	}
+	defer func() {
+		if recover() == nil { t.Errorf("Nth out of range should panic") }
+	}()
+	v.Nth(len(ex))
+}
+
+func TestVectorSlice(t *testing.T) {
+	var v Vector
+	ex := make([]int, 2500)
+	for i := range ex {
+		v = v.Conj(i)
+		ex[i] = i
+	}
+	for _, r := range [][2]int{{0, 0}, {0, 2500}, {0, 32}, {1, 33}, {100, 1124}, {31, 2499}, {2400, 2500}, {5, 6}} {
+		s := v.Slice(r[0], r[1])
+		checkVector(t, "Slice", s, ex[r[0]:r[1]])
+		// A slice is a Vector like any other.
+		checkVector(t, "Slice.Conj", s.Conj(-1).Pop(), ex[r[0]:r[1]])
+		if s.Count() > 0 { checkVector(t, "Slice.Pop", s.Pop(), ex[r[0]:r[1]-1]) }
+		if s.Count() > 0 && s.t.root != v.t.root { t.Errorf("Slice [%d:%d] copied the trie", r[0], r[1]) }
+	}
+	// Changing a slice leaves v alone, even where the slice takes over v's values.
+	s := v.Slice(100, 1124).Slice(24, 1000)
+	checkVector(t, "Slice.Slice", s, ex[124:1100])
+	ex2 := append([]int(nil), ex[124:1100]...)
+	for i := 0; i < 100; i++ {
+		s = s.Conj(-i); ex2 = append(ex2, -i)
+	}
+	s = s.AssocN(0, -1000); ex2[0] = -1000
+	checkVector(t, "Slice changed", s, ex2)
+	checkVector(t, "Slice original", v, ex)
+}
+
+func BenchmarkVectorConj(b *testing.B) {
+	var v Vector
+	for i := 0; i < b.N; i++ {
+		v = v.Conj(i)
+	}
+}
+func BenchmarkVectorNth(b *testing.B) {
+	b.StopTimer()
+	var v Vector
+	for i := 0; i < 100000; i++ {
+		v = v.Conj(i)
+	}
+	runtime.GC()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		v.Nth(i % 100000)
+	}
+}
+func BenchmarkVectorAssocN(b *testing.B) {
+	b.StopTimer()
+	var v Vector
+	for i := 0; i < 100000; i++ {
+		v = v.Conj(i)
+	}
+	runtime.GC()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		v = v.AssocN(i % 100000, i)
+	}
+}